@@ -3,8 +3,37 @@
 // See COPYING at the root of the repository for details.
 package config
 
+// Policies for messages that have been deleted on the other side
+const (
+	DeletePolicyDelete = "delete" // Delete the message
+	DeletePolicyTrash  = "trash"  // Move the message to the trash folder
+	DeletePolicyKeep   = "keep"   // Keep the message, but stop synchronizing it
+)
+
+// DefaultTrashFolder is used if no trash folder has been configured
+const DefaultTrashFolder = "Trash"
+
+// DefaultMaxDeleteRatio is used if no max_delete_ratio has been configured
+const DefaultMaxDeleteRatio = 0.5
+
+// Defaults used in daemon mode
+const (
+	DefaultIdleFolder   = "INBOX"
+	DefaultSyncInterval = 15 * 60
+)
+
+// Defaults used when the connection to the server is lost
+const (
+	DefaultMaxRetries = 5
+	DefaultRetryDelay = 1
+)
+
+// DefaultWorkers is the number of mailboxes synchronized at the same time, if not configured
+const DefaultWorkers = 4
+
 // Config describes the available configuration layout
 type Config struct {
+	Workers   int // Maximum number of mailboxes synchronized at the same time
 	Mailboxes map[string]Mailbox
 }
 
@@ -12,6 +41,27 @@ type Config struct {
 type Mailbox struct {
 	// Local settings
 	Maildir string // Local maildir storage
+	// How folders are stored in the maildir.
+	// One of "verbatim" (default), "fs" or "maildir++"
+	Layout string
+
+	// What to do with local messages that have been deleted on the server.
+	// One of "delete" (default), "trash" or "keep"
+	ServerDeletePolicy string `yaml:"server_delete"`
+	TrashFolder        string `yaml:"trash_folder"` // Folder used by the "trash" policy. Defaults to the server's trash folder
+
+	// What to do when a folder has been deleted on one side.
+	// Either "keep" (default), which recreates the folder from the other side, or "delete"
+	FolderDeletePolicy string `yaml:"folder_delete"`
+
+	// Messages that are deleted locally are flagged as \Deleted on the server.
+	// If ExpungeLocalDeletes is set, they are also expunged.
+	ExpungeLocalDeletes bool `yaml:"expunge_local_deletes"`
+	// The largest fraction of a folder that may be deleted locally before we refuse
+	// to propagate the deletions to the server. Defaults to 0.5.
+	// If FolderDeletePolicy is "delete", it also limits the fraction of all folders that may be deleted
+	// on the server because they have been deleted locally, e.g. if the maildir isn't mounted
+	MaxDeleteRatio float64 `yaml:"max_delete_ratio"`
 
 	// Remote settings
 	Server      string
@@ -21,9 +71,86 @@ type Mailbox struct {
 	PasswordCmd string `yaml:"password_cmd"`
 	UseTLS      bool   `yaml:"use_tls"`
 	UseStartTLS bool   `yaml:"use_starttls"`
+	Connections int    // Number of connections used to synchronize folders in parallel. Defaults to 1
+
+	// If the connection is lost, we reconnect and retry up to MaxRetries times (default 5, negative to disable).
+	// The delay between reconnection attempts starts at RetryDelay seconds, and is doubled for each attempt
+	MaxRetries int `yaml:"max_retries"`
+	RetryDelay int `yaml:"retry_delay"`
+
+	TLSCAFile      string `yaml:"tls_ca_file"`     // PEM file with the CA certificates used to verify the server
+	TLSCertFile    string `yaml:"tls_cert_file"`   // PEM file with a client certificate
+	TLSKeyFile     string `yaml:"tls_key_file"`    // PEM file with the key for the client certificate
+	TLSMinVersion  string `yaml:"tls_min_version"` // Minimum TLS version, e.g. "1.2"
+	TLSFingerprint string `yaml:"tls_fingerprint"` // SHA-256 fingerprint of the server certificate, which replaces normal verification
+
+	// Authentication mechanisms to use, in order of preference. The first one supported by the server is used.
+	// One of LOGIN (default), PLAIN, CRAM-MD5, SCRAM-SHA-256, EXTERNAL, XOAUTH2 or OAUTHBEARER
+	AuthMechanisms []string `yaml:"auth_mechanisms"`
+	// Allow credentials to be sent in cleartext over a connection that isn't encrypted
+	AllowInsecureAuth bool `yaml:"allow_insecure_auth"`
+
+	// If set, OAuth2 is used to authenticate instead of a password
+	OAuth2 *OAuth2 `yaml:"oauth2"`
+
+	Folders Folders
+
+	// Local names used for server folders, so that the local folders can keep the same names when
+	// the server names differ, e.g. "[Gmail]/Sent Mail" -> "Sent". Folders not listed keep their server names
+	FolderMap map[string]string `yaml:"folder_map"`
+	// Store special-use folders (RFC 6154) under the same local names for all servers,
+	// i.e. Sent, Drafts, Trash, Junk, Archive, All and Flagged, unless they're listed in FolderMap
+	SpecialUseNames bool `yaml:"special_use_names"`
+
+	// Daemon mode settings
+	IdleFolders  []string `yaml:"idle_folders"`  // Folders watched for changes on the server. Defaults to INBOX
+	PollInterval int      `yaml:"poll_interval"` // Seconds between polls, if the server doesn't support IDLE
+	SyncInterval int      `yaml:"sync_interval"` // Seconds between full synchronizations of all folders
+}
+
+// Folders selects which folders are synchronized.
+// Entries are either folder names, wildcard patterns where '*' matches any number of characters,
+// '%' matches any characters except the hierarchy delimiter and '?' matches a single character,
+// or regular expressions enclosed in '/'. Names containing a wildcard are always treated as patterns
+type Folders struct {
+	Include []string
+	Exclude []string
+
+	// Rules are checked in order before Include and Exclude, and the first matching rule decides if
+	// a folder is synchronized. If no rule matches, a folder is only synchronized if there are no include rules
+	Rules []FolderRule
+
+	// Log a warning instead of failing if a folder listed by name doesn't exist on the server
+	WarnMissing bool `yaml:"warn_missing"`
+}
+
+// FolderRule either includes or excludes the folders matching a pattern
+type FolderRule struct {
+	Include string
+	Exclude string
+}
+
+// OAuth2 defines the settings used to authenticate with an OAuth2 access token,
+// which is requested from the token endpoint using a refresh token
+type OAuth2 struct {
+	ClientID        string `yaml:"client_id"`
+	ClientSecret    string `yaml:"client_secret"`
+	ClientSecretCmd string `yaml:"client_secret_cmd"`
+	TokenURL        string `yaml:"token_url"`
+	Scopes          []string
+
+	// The refresh token can either be supplied directly, through a helper command, or read from a file.
+	// If the server issues a new refresh token, it's written back to the file, or kept in the token cache
+	// until the configured token is changed
+	RefreshToken     string `yaml:"refresh_token"`
+	RefreshTokenCmd  string `yaml:"refresh_token_cmd"`
+	RefreshTokenFile string `yaml:"refresh_token_file"`
+
+	// File used to cache access tokens between runs.
+	// Defaults to a file in the user's cache directory
+	TokenCache string `yaml:"token_cache"`
 
-	Folders struct {
-		Include []string
-		Exclude []string
-	}
+	// SASL mechanism, either "xoauth2" or "oauthbearer".
+	// By default, OAUTHBEARER is used if the server supports it, otherwise XOAUTH2
+	Mechanism string
 }
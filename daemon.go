@@ -0,0 +1,181 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/imap"
+)
+
+// localChangeDelay is how long we wait for the maildir to settle after a local change
+// before synchronizing, so that a batch of changes results in a single sync
+const localChangeDelay = 2 * time.Second
+
+// quietPeriod is how long the maildir must be left untouched after a sync before we
+// decide which of the local changes seen during the sync were made by someone else
+const quietPeriod = 200 * time.Millisecond
+
+// runDaemon synchronizes a mailbox, and then keeps it synchronized by watching for changes
+// on both the server and in the maildir, until the context is cancelled
+func runDaemon(ctx context.Context, name string, mailbox config.Mailbox) error {
+	a, err := openAccount(name, mailbox)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := a.Close(); err != nil {
+			log.Printf("%s: %v", name, err)
+		}
+	}()
+
+	err = a.sync(ctx)
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	idleFolders := mailbox.IdleFolders
+	if len(idleFolders) == 0 {
+		idleFolders = []string{config.DefaultIdleFolder}
+	}
+	pollInterval := time.Duration(mailbox.PollInterval) * time.Second
+	syncInterval := time.Duration(mailbox.SyncInterval) * time.Second
+	if syncInterval <= 0 {
+		syncInterval = config.DefaultSyncInterval * time.Second
+	}
+
+	// Each watched folder needs its own connection, since a connection
+	// can only have one folder selected at a time
+	remoteChanged := make(chan string, len(idleFolders))
+	for _, folder := range idleFolders {
+		go watchRemote(ctx, name, a.mailbox, folder, pollInterval, remoteChanged)
+	}
+
+	localChanged := make(chan string, 100)
+	go func() {
+		err := a.md.Watch(ctx, pollInterval, localChanged)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("%s: cannot watch maildir: %v", name, err)
+		}
+	}()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	var pending map[string]bool // Folders changed locally while synchronizing
+	for {
+		if len(pending) > 0 {
+			for folder := range pending {
+				log.Printf("%s: folder %s changed locally during sync", name, folder)
+				err = a.syncFolder(ctx, folder)
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return nil
+			case folder := <-remoteChanged:
+				log.Printf("%s: folder %s changed on server", name, folder)
+				err = a.syncFolder(ctx, folder)
+			case folder := <-localChanged:
+				folders := waitForLocalChanges(ctx, localChanged, folder)
+				for folder := range folders {
+					log.Printf("%s: folder %s changed locally", name, folder)
+					err = a.syncFolder(ctx, folder)
+					if err != nil {
+						break
+					}
+				}
+			case <-ticker.C:
+				err = a.sync(ctx)
+			}
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("%s: %v", name, err)
+		}
+		pending = a.localChangesDuringSync(ctx, localChanged)
+	}
+}
+
+// watchRemote keeps a separate connection to the server, and watches a single folder for changes.
+// If the connection fails, we'll reconnect after a while
+func watchRemote(ctx context.Context, name string, mailbox config.Mailbox, folder string, pollInterval time.Duration, changed chan<- string) {
+	for {
+		h, err := imap.NewWatcher(mailbox)
+		if err == nil {
+			err = h.Watch(ctx, folder, pollInterval, changed)
+			h.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("%s: cannot watch folder %s: %v", name, folder, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// waitForLocalChanges collects the names of all folders that change
+// until the maildir has been left alone for 'localChangeDelay'
+func waitForLocalChanges(ctx context.Context, changed <-chan string, folder string) map[string]bool {
+	folders := map[string]bool{folder: true}
+	for {
+		select {
+		case <-ctx.Done():
+			return folders
+		case f := <-changed:
+			folders[f] = true
+		case <-time.After(localChangeDelay):
+			return folders
+		}
+	}
+}
+
+// localChangesDuringSync returns the folders that have been changed locally by someone else while we were synchronizing.
+// Notifications are collected until the maildir has been left alone for 'quietPeriod', since renaming and
+// downloading messages also counts as changes. Those changes are recorded in the folder state, which is
+// used to tell them apart from changes made by the user, so that those are synchronized right away
+func (a *account) localChangesDuringSync(ctx context.Context, changed <-chan string) map[string]bool {
+	folders := make(map[string]bool)
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case f := <-changed:
+			folders[f] = true
+		case <-time.After(quietPeriod):
+			break wait
+		}
+	}
+
+	pending := make(map[string]bool)
+	for folder := range folders {
+		changed, err := a.md.HasLocalChanges(folder)
+		if err != nil {
+			log.Printf("%s: %v", a.name, err)
+			continue
+		}
+		if changed {
+			pending[folder] = true
+		}
+	}
+	return pending
+}
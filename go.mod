@@ -5,8 +5,8 @@ go 1.14
 require (
 	github.com/emersion/go-imap v1.0.5
 	github.com/emersion/go-imap-uidplus v0.0.0-20200503180755-e75854c361e9
+	github.com/emersion/go-sasl v0.0.0-20191210011802-430746ea8b9b
 	github.com/schollz/progressbar/v3 v3.5.1
-	github.com/yzzyx/nm-imap-sync v0.0.0-20201001075551-d9d38d69922f
-	github.com/zenhack/go.notmuch v0.0.0-20200930180226-732f6524c33d
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,258 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Supported authentication mechanisms.
+// LOGIN refers to the IMAP LOGIN command, and not the SASL mechanism with the same name
+const (
+	mechLogin       = "LOGIN"
+	mechPlain       = "PLAIN"
+	mechCramMD5     = "CRAM-MD5"
+	mechScramSHA256 = "SCRAM-SHA-256"
+	mechExternal    = "EXTERNAL"
+)
+
+// cleartextMechanisms are the mechanisms that send credentials that can be reused by anyone listening
+var cleartextMechanisms = map[string]bool{
+	mechLogin:       true,
+	mechPlain:       true,
+	mechXOAuth2:     true,
+	mechOAuthBearer: true,
+}
+
+// authenticate logs in using the first of the configured mechanisms that the server supports.
+// Only one mechanism is tried, since repeated login failures might cause the account to be locked
+func (h *Handler) authenticate() error {
+	mechs := h.mailbox.AuthMechanisms
+	if len(mechs) == 0 {
+		if h.tokens != nil {
+			mechs = h.oauth2Mechanisms()
+		} else {
+			mechs = []string{mechLogin}
+		}
+	}
+
+	insecure := !h.client.IsTLS() && !h.mailbox.AllowInsecureAuth
+	var refused []string
+	for _, mech := range mechs {
+		mech = strings.ToUpper(mech)
+
+		var ok bool
+		var err error
+		if mech == mechLogin {
+			ok, err = h.client.Support("LOGINDISABLED")
+			ok = !ok
+		} else {
+			ok, err = h.client.SupportAuth(mech)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if insecure && cleartextMechanisms[mech] {
+			refused = append(refused, mech)
+			continue
+		}
+
+		if mech == mechLogin {
+			return h.client.Login(h.mailbox.Username, h.mailbox.Password)
+		}
+
+		auth, err := h.saslClient(mech)
+		if err != nil {
+			return err
+		}
+
+		err = h.client.Authenticate(auth)
+		if err != nil {
+			return fmt.Errorf("authentication with %s failed: %w", mech, err)
+		}
+		if h.tokens != nil {
+			h.tokenExpiry = h.tokens.Expiry()
+		}
+		return nil
+	}
+
+	if len(refused) > 0 {
+		return fmt.Errorf("refusing to authenticate with %s over an unencrypted connection (use TLS, or set allow_insecure_auth)",
+			strings.Join(refused, ", "))
+	}
+	return fmt.Errorf("server doesn't support any of the authentication mechanisms %s", strings.Join(mechs, ", "))
+}
+
+// saslClient returns a SASL client for a mechanism
+func (h *Handler) saslClient(mech string) (sasl.Client, error) {
+	switch mech {
+	case mechPlain:
+		return sasl.NewPlainClient("", h.mailbox.Username, h.mailbox.Password), nil
+	case mechCramMD5:
+		return &cramMD5Client{username: h.mailbox.Username, password: h.mailbox.Password}, nil
+	case mechScramSHA256:
+		return &scramClient{username: h.mailbox.Username, password: h.mailbox.Password}, nil
+	case mechExternal:
+		return sasl.NewExternalClient(""), nil
+	case mechXOAuth2, mechOAuthBearer:
+		return h.oauth2Client(mech)
+	}
+	return nil, fmt.Errorf("unsupported authentication mechanism %s", mech)
+}
+
+// cramMD5Client implements the CRAM-MD5 mechanism, as defined in RFC 2195
+type cramMD5Client struct {
+	username string
+	password string
+}
+
+func (c *cramMD5Client) Start() (string, []byte, error) {
+	return mechCramMD5, nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// scramClient implements the SCRAM-SHA-256 mechanism, as defined in RFC 5802 and RFC 7677.
+// Channel binding is not supported
+type scramClient struct {
+	username string
+	password string
+
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// scramGS2Header is the GS2 header used when channel binding is not supported
+const scramGS2Header = "n,,"
+
+func (c *scramClient) Start() (string, []byte, error) {
+	// The username and password must be prepared with SASLprep (RFC 4013), which is not implemented.
+	// It doesn't change printable ASCII, so anything else is refused, instead of failing to authenticate
+	if !scramPrintable(c.username) || !scramPrintable(c.password) {
+		return "", nil, errors.New("SCRAM-SHA-256 is only supported for usernames and passwords consisting of printable ASCII characters")
+	}
+
+	if c.clientNonce == "" {
+		nonce := make([]byte, 24)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", nil, err
+		}
+		c.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+	}
+
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.username)
+	c.clientFirstBare = "n=" + username + ",r=" + c.clientNonce
+	c.step = 1
+	return mechScramSHA256, []byte(scramGS2Header + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	switch c.step {
+	case 1:
+		c.step++
+		return c.clientFinal(string(challenge))
+	case 2:
+		c.step++
+		attrs := scramAttributes(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, fmt.Errorf("SCRAM authentication failed: %s", e)
+		}
+		signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(signature, c.serverSignature) {
+			return nil, errors.New("SCRAM server signature mismatch")
+		}
+		return []byte{}, nil
+	}
+	return nil, errors.New("unexpected SCRAM challenge")
+}
+
+// clientFinal computes the client-final-message from the server-first-message
+func (c *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttributes(serverFirst)
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, errors.New("invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCRAM salt: %w", err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("invalid SCRAM iteration count")
+	}
+
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+
+	saltedPassword := pbkdf2.Key([]byte(c.password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+	c.serverSignature = hmacSHA256(serverKey, authMessage)
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// scramAttributes parses a SCRAM message, consisting of comma-separated attribute=value pairs
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			continue
+		}
+		attrs[field[:1]] = field[2:]
+	}
+	return attrs
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramPrintable returns true if 's' only contains printable ASCII characters, which SASLprep leaves unchanged
+func scramPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// usesExternalAuth returns true if only EXTERNAL has been configured, in which case no password is needed
+func (h *Handler) usesExternalAuth() bool {
+	mechs := h.mailbox.AuthMechanisms
+	return len(mechs) == 1 && strings.ToUpper(mechs[0]) == mechExternal
+}
@@ -0,0 +1,201 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"github.com/yzzyx/imap-sync/config"
+)
+
+func TestScramSHA256(t *testing.T) {
+	// Example exchange from RFC 7677, section 3
+	c := &scramClient{username: "user", password: "pencil", clientNonce: "rOprNGfwEbeRWgbNEkqO"}
+
+	mech, ir, err := c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != mechScramSHA256 || string(ir) != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("got initial response %s %q", mech, ir)
+	}
+
+	resp, err := c.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(resp) != expected {
+		t.Errorf("got client-final-message %q, expected %q", resp, expected)
+	}
+
+	_, err = c.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	if err != nil {
+		t.Errorf("server signature was not accepted: %v", err)
+	}
+}
+
+func TestScramSHA256NonASCII(t *testing.T) {
+	tests := []struct {
+		username string
+		password string
+	}{
+		{"user", "pässword"},
+		{"üser", "pencil"},
+		{"user", "pencil\x00"},
+	}
+
+	for _, tt := range tests {
+		c := &scramClient{username: tt.username, password: tt.password}
+		_, _, err := c.Start()
+		if err == nil || !strings.Contains(err.Error(), "printable ASCII") {
+			t.Errorf("username %q and password %q: got error %v, expected them to be refused", tt.username, tt.password, err)
+		}
+	}
+}
+
+func TestCramMD5(t *testing.T) {
+	// Example exchange from RFC 2195, section 2
+	c := &cramMD5Client{username: "tim", password: "tanstaaftanstaaf"}
+	mech, ir, err := c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != mechCramMD5 || ir != nil {
+		t.Errorf("got initial response %s %q, expected CRAM-MD5 without initial response", mech, ir)
+	}
+
+	resp, err := c.Next([]byte("<1896.697170952@postoffice.reston.mci.net>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "tim b913a602c7eda7a495b4e6e7334d3890"
+	if string(resp) != expected {
+		t.Errorf("got response %q, expected %q", resp, expected)
+	}
+}
+
+// cramMD5Server is the server side of CRAM-MD5, which logs in to the backend as 'username'
+type cramMD5Server struct {
+	conn      server.Conn
+	be        backend.Backend
+	challenge string
+}
+
+func (s *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte(s.challenge), false, nil
+	}
+
+	mac := hmac.New(md5.New, []byte("password"))
+	mac.Write([]byte(s.challenge))
+	if string(response) != "username "+hex.EncodeToString(mac.Sum(nil)) {
+		return nil, true, errors.New("invalid CRAM-MD5 response")
+	}
+
+	user, err := s.be.Login(s.conn.Info(), "username", "password")
+	if err != nil {
+		return nil, true, err
+	}
+	ctx := s.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil, true, nil
+}
+
+// newAuthServer starts an IMAP server that supports LOGIN, PLAIN and CRAM-MD5, with or without TLS,
+// and returns the configuration used to connect to it
+func newAuthServer(t *testing.T, useTLS bool) config.Mailbox {
+	t.Helper()
+
+	be := memory.New()
+	mailbox := config.Mailbox{Server: "127.0.0.1", Username: "username", Password: "password"}
+	var l net.Listener
+	var err error
+	if useTLS {
+		cert := newSelfSignedCert(t)
+		sum := sha256.Sum256(cert.Certificate[0])
+		mailbox.UseTLS = true
+		mailbox.TLSFingerprint = formatFingerprint(sum[:])
+		l, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox.Port = l.Addr().(*net.TCPAddr).Port
+
+	s := server.New(be)
+	// The server offers every mechanism, so that it's up to the client to refuse them
+	s.AllowInsecureAuth = true
+	s.EnableAuth(mechCramMD5, func(conn server.Conn) sasl.Server {
+		return &cramMD5Server{conn: conn, be: be, challenge: "<1896.697170952@example.com>"}
+	})
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return mailbox
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		mechs         []string
+		useTLS        bool
+		allowInsecure bool
+		password      string
+		err           string
+	}{
+		{"LOGIN without TLS", nil, false, false, "", "refusing to authenticate with LOGIN"},
+		{"LOGIN without TLS allowed", nil, false, true, "", ""},
+		{"LOGIN with TLS", nil, true, false, "", ""},
+		{"PLAIN without TLS", []string{"plain"}, false, false, "", "refusing to authenticate with PLAIN"},
+		{"PLAIN without TLS allowed", []string{"PLAIN"}, false, true, "", ""},
+		{"PLAIN with TLS", []string{"PLAIN"}, true, false, "", ""},
+		{"CRAM-MD5 without TLS", []string{"CRAM-MD5"}, false, false, "", ""},
+		{"CRAM-MD5 after refused PLAIN", []string{"PLAIN", "CRAM-MD5"}, false, false, "", ""},
+		{"CRAM-MD5 wrong password", []string{"CRAM-MD5"}, false, false, "wrong", "authentication with CRAM-MD5 failed"},
+		{"unsupported mechanism", []string{"SCRAM-SHA-256"}, false, false, "", "doesn't support any of the authentication mechanisms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailbox := newAuthServer(t, tt.useTLS)
+			mailbox.AuthMechanisms = tt.mechs
+			mailbox.AllowInsecureAuth = tt.allowInsecure
+			if tt.password != "" {
+				mailbox.Password = tt.password
+			}
+
+			h, err := New(mailbox)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("cannot log in: %v", err)
+				}
+				h.Close()
+				return
+			}
+			if err == nil {
+				h.Close()
+				t.Fatalf("logged in, expected error containing %q", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Capabilities used for incremental synchronization (RFC 7162)
+const (
+	capCondStore = "CONDSTORE"
+	capQResync   = "QRESYNC"
+)
+
+// enableCommand is an ENABLE command, as defined in RFC 5161
+type enableCommand struct {
+	Capabilities []string
+}
+
+func (cmd *enableCommand) Command() *imap.Command {
+	args := make([]interface{}, len(cmd.Capabilities))
+	for i, c := range cmd.Capabilities {
+		args[i] = imap.RawString(c)
+	}
+	return &imap.Command{Name: "ENABLE", Arguments: args}
+}
+
+// selectCommand is a SELECT command with the CONDSTORE or QRESYNC parameters defined in RFC 7162.
+// If ModSeq is set, QRESYNC is used, otherwise CONDSTORE
+type selectCommand struct {
+	Mailbox     string
+	UIDValidity uint32
+	ModSeq      uint64
+}
+
+func (cmd *selectCommand) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+
+	var params []interface{}
+	if cmd.ModSeq > 0 {
+		params = []interface{}{
+			imap.RawString(capQResync),
+			[]interface{}{cmd.UIDValidity, formatModSeq(cmd.ModSeq)},
+		}
+	} else {
+		params = []interface{}{imap.RawString(capCondStore)}
+	}
+
+	return &imap.Command{
+		Name:      "SELECT",
+		Arguments: []interface{}{imap.FormatMailboxName(mailbox), params},
+	}
+}
+
+// fetchChangedCommand is a FETCH command with the CHANGEDSINCE modifier defined in RFC 7162
+type fetchChangedCommand struct {
+	commands.Fetch
+	ChangedSince uint64
+}
+
+func (cmd *fetchChangedCommand) Command() *imap.Command {
+	c := cmd.Fetch.Command()
+	c.Arguments = append(c.Arguments, []interface{}{
+		imap.RawString("CHANGEDSINCE"),
+		formatModSeq(cmd.ChangedSince),
+	})
+	return c
+}
+
+// changes collects the responses used for incremental synchronization
+type changes struct {
+	HighestModSeq uint64
+	Vanished      *imap.SeqSet
+	Messages      []*imap.Message
+}
+
+// handler returns a response handler that collects HIGHESTMODSEQ, VANISHED and FETCH responses.
+// Any other responses are passed on to 'next'
+func (c *changes) handler(next responses.Handler) responses.Handler {
+	return responses.HandlerFunc(func(resp imap.Resp) error {
+		switch r := resp.(type) {
+		case *imap.StatusResp:
+			if r.Code == "HIGHESTMODSEQ" && len(r.Arguments) > 0 {
+				c.HighestModSeq = parseModSeq(r.Arguments[0])
+				return nil
+			}
+		case *imap.DataResp:
+			name, fields, ok := imap.ParseNamedResp(resp)
+			if !ok {
+				break
+			}
+
+			switch name {
+			case "VANISHED":
+				// VANISHED (EARLIER) <uid set>
+				if len(fields) == 0 {
+					return nil
+				}
+				s, _ := fields[len(fields)-1].(string)
+				if set, err := imap.ParseSeqSet(s); err == nil {
+					if c.Vanished == nil {
+						c.Vanished = new(imap.SeqSet)
+					}
+					c.Vanished.AddSet(set)
+				}
+				return nil
+			case "FETCH":
+				if len(fields) < 2 {
+					return nil
+				}
+				seqNum, _ := imap.ParseNumber(fields[0])
+				msgFields, _ := fields[1].([]interface{})
+				msg := &imap.Message{SeqNum: seqNum}
+				if err := msg.Parse(msgFields); err != nil {
+					return err
+				}
+				c.Messages = append(c.Messages, msg)
+				return nil
+			}
+		}
+
+		if next == nil {
+			return responses.ErrUnhandled
+		}
+		return next.Handle(resp)
+	})
+}
+
+// selectChanged selects a mailbox, and enables CONDSTORE for it.
+// If QRESYNC is enabled, and we know the modification sequence from the last sync,
+// the server also reports which messages have been changed or expunged since then.
+func (h *Handler) selectChanged(folderName string, uidValidity uint32, modSeq uint64) (*imap.MailboxStatus, *changes, error) {
+	cmd := &selectCommand{Mailbox: folderName}
+	if h.qresync && uidValidity > 0 {
+		cmd.UIDValidity = uidValidity
+		cmd.ModSeq = modSeq
+	}
+
+	mbox := &imap.MailboxStatus{Name: folderName, Items: make(map[imap.StatusItem]interface{})}
+	c := &changes{}
+
+	// The mailbox must be set before the command is executed,
+	// since the number of messages is received as an unilateral response
+	h.client.SetState(imap.AuthenticatedState, mbox)
+	status, err := h.client.Execute(cmd, c.handler(&responses.Select{Mailbox: mbox}))
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		h.client.SetState(imap.AuthenticatedState, nil)
+		return nil, nil, err
+	}
+
+	mbox.ReadOnly = status.Code == imap.CodeReadOnly
+	h.client.SetState(imap.SelectedState, mbox)
+	return mbox, c, nil
+}
+
+// fetchChanged returns UID and flags for all messages in 'seqSet' that have changed since 'modSeq'
+func (h *Handler) fetchChanged(seqSet *imap.SeqSet, modSeq uint64) ([]*imap.Message, error) {
+	cmd := &commands.Uid{Cmd: &fetchChangedCommand{
+		Fetch: commands.Fetch{
+			SeqSet: seqSet,
+			Items:  []imap.FetchItem{imap.FetchUid, imap.FetchFlags},
+		},
+		ChangedSince: modSeq,
+	}}
+
+	c := &changes{}
+	status, err := h.client.Execute(cmd, c.handler(nil))
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.Messages, nil
+}
+
+// formatModSeq formats a mod-sequence, which might be too large for the types supported by imap.Writer
+func formatModSeq(modSeq uint64) imap.RawString {
+	return imap.RawString(strconv.FormatUint(modSeq, 10))
+}
+
+// parseModSeq parses a mod-sequence. Returns 0 if it can't be parsed
+func parseModSeq(f interface{}) uint64 {
+	switch v := f.(type) {
+	case uint32:
+		return uint64(v)
+	case string:
+		n, _ := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,461 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// condstoreBackend is a memory backend that supports CONDSTORE, and QRESYNC if 'qresync' is set (RFC 7162).
+// Mod-sequences are only assigned to changes made through the backend, so the message that
+// the memory backend creates in INBOX is never reported as changed.
+// It's also a server extension, which is enabled by newTestBackendHandler
+type condstoreBackend struct {
+	*memory.Backend
+	qresync bool
+
+	mu       sync.Mutex
+	modSeq   uint64                       // Highest mod-sequence, shared by all folders
+	changed  map[string]map[uint32]uint64 // Mod-sequence of the last change of each message, by folder
+	expunged map[string]map[uint32]uint64 // Mod-sequence at which each message was expunged, by folder
+	failing  string                       // Folder that can't be selected
+	fetched  int                          // Number of messages returned by FETCH CHANGEDSINCE
+}
+
+func newCondstoreBackend(qresync bool) *condstoreBackend {
+	return &condstoreBackend{
+		Backend:  memory.New(),
+		qresync:  qresync,
+		modSeq:   1,
+		changed:  make(map[string]map[uint32]uint64),
+		expunged: make(map[string]map[uint32]uint64),
+	}
+}
+
+func (be *condstoreBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &condstoreUser{User: user, be: be}, nil
+}
+
+// setFailing makes SELECT fail for a folder, or for no folder if 'folderName' is empty
+func (be *condstoreBackend) setFailing(folderName string) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.failing = folderName
+}
+
+// change assigns a new mod-sequence to a message
+func (be *condstoreBackend) change(folderName string, uid uint32) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.changed[folderName] == nil {
+		be.changed[folderName] = make(map[uint32]uint64)
+	}
+	be.modSeq++
+	be.changed[folderName][uid] = be.modSeq
+}
+
+// expunge records that a message has been expunged
+func (be *condstoreBackend) expunge(folderName string, uid uint32) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if be.expunged[folderName] == nil {
+		be.expunged[folderName] = make(map[uint32]uint64)
+	}
+	be.modSeq++
+	be.expunged[folderName][uid] = be.modSeq
+	delete(be.changed[folderName], uid)
+}
+
+func (be *condstoreBackend) Capabilities(c server.Conn) []string {
+	if be.qresync {
+		return []string{capCondStore, "ENABLE", capQResync}
+	}
+	return []string{capCondStore}
+}
+
+func (be *condstoreBackend) Command(name string) server.HandlerFactory {
+	switch name {
+	case "ENABLE":
+		if be.qresync {
+			return func() server.Handler { return &condstoreEnable{} }
+		}
+	case "SELECT":
+		return func() server.Handler { return &condstoreSelect{be: be} }
+	case "FETCH":
+		return func() server.Handler { return &condstoreFetch{be: be} }
+	}
+	return nil
+}
+
+// writeChanged writes a FETCH response with UID and flags for each message in 'seqSet' changed after 'modSeq'.
+// Returns the number of messages written
+func (be *condstoreBackend) writeChanged(conn server.Conn, mbox *condstoreMailbox, seqSet *imap.SeqSet, modSeq uint64) (int, error) {
+	be.mu.Lock()
+	changed := be.changed[mbox.Name()]
+	be.mu.Unlock()
+
+	var count int
+	for i, msg := range mbox.mem.Messages {
+		if (seqSet != nil && !seqSet.Contains(msg.Uid)) || changed[msg.Uid] <= modSeq {
+			continue
+		}
+
+		var flags []interface{}
+		for _, f := range msg.Flags {
+			flags = append(flags, imap.RawString(f))
+		}
+		err := conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+			uint32(i + 1), imap.RawString("FETCH"),
+			[]interface{}{imap.RawString("UID"), msg.Uid, imap.RawString("FLAGS"), flags},
+		}))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+type condstoreUser struct {
+	backend.User
+	be *condstoreBackend
+}
+
+// ListMailboxes returns the folders sorted by name, so that they're synchronized in a known order
+func (u *condstoreUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes, err := u.User.ListMailboxes(subscribed)
+	sort.Slice(mailboxes, func(i, j int) bool { return mailboxes[i].Name() < mailboxes[j].Name() })
+	return mailboxes, err
+}
+
+func (u *condstoreUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &condstoreMailbox{Mailbox: mbox, mem: mbox.(*memory.Mailbox), user: u, be: u.be}, nil
+}
+
+type condstoreMailbox struct {
+	backend.Mailbox
+	mem  *memory.Mailbox
+	user *condstoreUser
+	be   *condstoreBackend
+}
+
+func (mbox *condstoreMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	err := mbox.Mailbox.CreateMessage(flags, date, body)
+	if err == nil {
+		mbox.be.change(mbox.Name(), mbox.mem.Messages[len(mbox.mem.Messages)-1].Uid)
+	}
+	return err
+}
+
+func (mbox *condstoreMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	err := mbox.Mailbox.UpdateMessagesFlags(uid, seqSet, op, flags)
+	if err != nil {
+		return err
+	}
+	for i, msg := range mbox.mem.Messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.Uid
+		}
+		if seqSet.Contains(id) {
+			mbox.be.change(mbox.Name(), msg.Uid)
+		}
+	}
+	return nil
+}
+
+func (mbox *condstoreMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	dest, err := mbox.user.User.GetMailbox(destName)
+	if err != nil {
+		return err
+	}
+	messages := dest.(*memory.Mailbox).Messages
+	err = mbox.Mailbox.CopyMessages(uid, seqSet, destName)
+	for _, msg := range dest.(*memory.Mailbox).Messages[len(messages):] {
+		mbox.be.change(destName, msg.Uid)
+	}
+	return err
+}
+
+func (mbox *condstoreMailbox) Expunge() error {
+	for _, msg := range mbox.mem.Messages {
+		for _, f := range msg.Flags {
+			if f == imap.DeletedFlag {
+				mbox.be.expunge(mbox.Name(), msg.Uid)
+			}
+		}
+	}
+	return mbox.Mailbox.Expunge()
+}
+
+// condstoreEnable handles ENABLE QRESYNC
+type condstoreEnable struct{}
+
+func (cmd *condstoreEnable) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (cmd *condstoreEnable) Handle(conn server.Conn) error {
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{imap.RawString("ENABLED"), imap.RawString(capQResync)}))
+}
+
+// condstoreSelect handles SELECT with the CONDSTORE and QRESYNC parameters
+type condstoreSelect struct {
+	server.Select
+	be          *condstoreBackend
+	uidValidity uint32
+	modSeq      uint64
+}
+
+func (cmd *condstoreSelect) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		// SELECT <mailbox> (QRESYNC (<uidvalidity> <modseq>))
+		params, _ := fields[1].([]interface{})
+		if len(params) == 2 && strings.EqualFold(fmt.Sprint(params[0]), capQResync) {
+			if args, ok := params[1].([]interface{}); ok && len(args) >= 2 {
+				cmd.uidValidity, _ = imap.ParseNumber(args[0])
+				cmd.modSeq = parseModSeq(args[1])
+			}
+		}
+	}
+	return cmd.Select.Parse(fields[:1])
+}
+
+func (cmd *condstoreSelect) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	cmd.be.mu.Lock()
+	failing := cmd.be.failing == cmd.Mailbox
+	highest := cmd.be.modSeq
+	var vanished []uint32
+	for uid, modSeq := range cmd.be.expunged[cmd.Mailbox] {
+		if modSeq > cmd.modSeq {
+			vanished = append(vanished, uid)
+		}
+	}
+	cmd.be.mu.Unlock()
+	if failing {
+		return errors.New("folder is unavailable")
+	}
+
+	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+	err = conn.WriteResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "HIGHESTMODSEQ",
+		Arguments: []interface{}{formatModSeq(highest)},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Changes since the last sync are only reported if the client knows the current UID validity
+	if cmd.modSeq > 0 && cmd.uidValidity == 1 {
+		if len(vanished) > 0 {
+			seqSet := new(imap.SeqSet)
+			seqSet.AddNum(vanished...)
+			err = conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+				imap.RawString("VANISHED"), []interface{}{imap.RawString("EARLIER")}, imap.RawString(seqSet.String()),
+			}))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = cmd.be.writeChanged(conn, mbox.(*condstoreMailbox), nil, cmd.modSeq)
+		if err != nil {
+			return err
+		}
+	}
+	return cmd.Select.Handle(conn)
+}
+
+// condstoreFetch handles FETCH with the CHANGEDSINCE modifier
+type condstoreFetch struct {
+	server.Fetch
+	be           *condstoreBackend
+	changedSince uint64
+}
+
+func (cmd *condstoreFetch) Parse(fields []interface{}) error {
+	if len(fields) > 2 {
+		// FETCH <seqset> <items> (CHANGEDSINCE <modseq>)
+		mods, _ := fields[2].([]interface{})
+		if len(mods) == 2 && strings.EqualFold(fmt.Sprint(mods[0]), "CHANGEDSINCE") {
+			cmd.changedSince = parseModSeq(mods[1])
+		}
+		fields = fields[:2]
+	}
+	return cmd.Fetch.Parse(fields)
+}
+
+func (cmd *condstoreFetch) UidHandle(conn server.Conn) error {
+	if cmd.changedSince == 0 {
+		return cmd.Fetch.UidHandle(conn)
+	}
+
+	mbox, ok := conn.Context().Mailbox.(*condstoreMailbox)
+	if !ok {
+		return errors.New("no mailbox selected")
+	}
+	n, err := cmd.be.writeChanged(conn, mbox, cmd.SeqSet, cmd.changedSince)
+
+	cmd.be.mu.Lock()
+	cmd.be.fetched += n
+	cmd.be.mu.Unlock()
+	return err
+}
+
+// createMessages creates a message with a unique Message-ID in a folder on the server for each subject
+func createMessages(t *testing.T, user backend.User, folderName string, subjects ...string) {
+	t.Helper()
+
+	mbox, err := user.GetMailbox(folderName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range subjects {
+		body := fmt.Sprintf("Message-ID: <%s@example.com>\r\nSubject: %s\r\n\r\nhello\r\n", subject, subject)
+		err = mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestMaildir returns a maildir in a temporary directory, which is removed when the test ends
+func newTestMaildir(t *testing.T) *maildir.Maildir {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "imap-sync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	md, err := maildir.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { md.Close() })
+	return md
+}
+
+func TestFetchChanged(t *testing.T) {
+	for _, qresync := range []bool{false, true} {
+		t.Run(fmt.Sprintf("qresync=%v", qresync), func(t *testing.T) {
+			be := newCondstoreBackend(qresync)
+			h, user := newTestBackendHandler(t, be, config.Mailbox{})
+			if !h.condstore || h.qresync != qresync {
+				t.Fatalf("got condstore=%v qresync=%v, expected condstore=true qresync=%v", h.condstore, h.qresync, qresync)
+			}
+
+			// The memory backend creates INBOX with a message with UID 6
+			createMessages(t, user, "INBOX", "a", "b", "c")
+			md := newTestMaildir(t)
+			err := h.CheckMessages(context.Background(), md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, err := md.State("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.HighestModSeq() == 0 {
+				t.Fatal("mod-sequence was not recorded")
+			}
+
+			mbox, err := user.GetMailbox("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			seqSet := new(imap.SeqSet)
+			seqSet.AddNum(8)
+			err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.FlaggedFlag})
+			if err != nil {
+				t.Fatal(err)
+			}
+			seqSet = new(imap.SeqSet)
+			seqSet.AddNum(9)
+			err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.DeletedFlag})
+			if err == nil {
+				err = mbox.Expunge()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, c, err := h.selectChanged("INBOX", uint32(state.UIDValidity()), state.HighestModSeq())
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote, err := h.fetchServerMessages(status, c, state, uint32(state.LastUID()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !remote.changedOnly {
+				t.Fatal("all messages were fetched, expected only the changed ones")
+			}
+			if len(remote.flags) != 1 || !mail.FlagsEqual(remote.flags[8], []string{mail.FlagFlagged, mail.FlagSeen}) {
+				t.Errorf("got changed messages %v, expected only UID 8 with flags FS", remote.flags)
+			}
+			if len(remote.vanished) != 1 || !remote.vanished[9] {
+				t.Errorf("got vanished messages %v, expected only UID 9", remote.vanished)
+			}
+			if !qresync && be.fetched != 1 {
+				t.Errorf("FETCH CHANGEDSINCE returned %d messages, expected 1", be.fetched)
+			}
+
+			err = h.CheckMessages(context.Background(), md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages, err := md.SyncedMessages("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := messages[9]; ok || len(messages) != 3 {
+				t.Errorf("got local messages %v, expected UID 9 to be removed", messages)
+			}
+			if info := messages[8]; !mail.FlagsEqual(info.Flags, []string{mail.FlagFlagged, mail.FlagSeen}) {
+				t.Errorf("local message with UID 8 has flags %v, expected FS", info.Flags)
+			}
+			if _, ok := state.Message(9); ok {
+				t.Error("UID 9 is still part of the folder state")
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// syncExpunged handles messages that have been synchronized earlier, but no longer exists on the server.
+// The local copy is handled according to the configured policy.
+func (h *Handler) syncExpunged(ctx context.Context, md *maildir.Maildir, folderName string, server *serverMessages) error {
+	state, err := md.State(folderName)
+	if err != nil {
+		return err
+	}
+
+	messages, err := md.SyncedMessages(folderName)
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range state.UIDs() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if server.exists(uid) {
+			continue
+		}
+
+		info, ok := messages[uid]
+		if !ok {
+			// Message has been removed on both sides
+			err = state.RemoveMessage(uid)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if h.deferServerDelete(info) {
+			continue
+		}
+		err = h.handleServerDelete(md, info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleServerDelete handles the local copy of a message that no longer exists on the server,
+// according to the configured policy
+func (h *Handler) handleServerDelete(md *maildir.Maildir, info mail.Info) error {
+	switch h.mailbox.ServerDeletePolicy {
+	case config.DeletePolicyDelete, "":
+		return md.RemoveMessage(info)
+	case config.DeletePolicyTrash:
+		trashFolder := h.mailbox.TrashFolder
+		if trashFolder == "" {
+			// Use the same folder as the server, if it has one
+			var ok bool
+			trashFolder, ok = h.SpecialFolder(SpecialUseTrash)
+			if !ok {
+				trashFolder = config.DefaultTrashFolder
+			}
+		}
+		return md.TrashMessage(info, trashFolder)
+	case config.DeletePolicyKeep:
+		return md.ForgetMessage(info)
+	}
+	return fmt.Errorf("unknown server_delete policy %q", h.mailbox.ServerDeletePolicy)
+}
+
+// minDeleteCheckMessages is the number of messages a folder must contain before
+// we check the ratio of locally deleted messages against MaxDeleteRatio
+const minDeleteCheckMessages = 10
+
+// syncLocalDeletes flags messages that have been deleted locally as \Deleted on the server,
+// and optionally expunges them. If an unusually large part of the folder has disappeared,
+// we assume that something is wrong, and abort instead.
+func (h *Handler) syncLocalDeletes(ctx context.Context, md *maildir.Maildir, folderName string, server *serverMessages) error {
+	state, err := md.State(folderName)
+	if err != nil {
+		return err
+	}
+
+	messages, err := md.SyncedMessages(folderName)
+	if err != nil {
+		return err
+	}
+
+	uids := state.UIDs()
+	seqSet := new(imap.SeqSet)
+	var deleted []int
+	for _, uid := range uids {
+		if _, ok := messages[uid]; ok {
+			continue
+		}
+		if !server.exists(uid) {
+			continue
+		}
+		seqSet.AddNum(uint32(uid))
+		deleted = append(deleted, uid)
+	}
+
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	if len(uids) >= minDeleteCheckMessages && float64(len(deleted))/float64(len(uids)) > h.maxDeleteRatio() {
+		return fmt.Errorf("%d of %d messages in folder %s have been deleted locally, which exceeds max_delete_ratio - refusing to delete them on the server",
+			len(deleted), len(uids), folderName)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	err = h.deleteUIDs(seqSet, h.mailbox.ExpungeLocalDeletes)
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range deleted {
+		err = state.RemoveMessage(uid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxDeleteRatio returns the largest fraction of messages in a folder, or of all folders,
+// that may be deleted locally before we refuse to delete them on the server
+func (h *Handler) maxDeleteRatio() float64 {
+	if h.mailbox.MaxDeleteRatio == 0 {
+		return config.DefaultMaxDeleteRatio
+	}
+	return h.mailbox.MaxDeleteRatio
+}
+
+// deleteUIDs flags messages in the selected folder as deleted, and optionally expunges them
+func (h *Handler) deleteUIDs(seqSet *imap.SeqSet, expunge bool) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	err := h.client.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil)
+	if err != nil || !expunge {
+		return err
+	}
+
+	hasUIDPlus, err := h.client.SupportUidPlus()
+	if err != nil {
+		return err
+	}
+
+	// Without UIDPLUS we can only expunge all messages flagged as deleted,
+	// which might include messages the user wants to keep
+	if !hasUIDPlus {
+		log.Printf("server does not support UIDPLUS, messages in %s are flagged as deleted but not expunged", h.client.Mailbox().Name)
+		return nil
+	}
+	return h.client.UidExpunge(seqSet, nil)
+}
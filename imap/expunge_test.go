@@ -0,0 +1,186 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/mail"
+)
+
+func TestSyncLocalDeletesRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int
+		deleted  int     // Number of messages deleted locally
+		maxRatio float64 // Configured max_delete_ratio
+		refused  bool
+	}{
+		{"below ratio", 10, 4, 0, false},
+		{"at ratio", 10, 5, 0, false},
+		{"above ratio", 10, 6, 0, true},
+		{"above configured ratio", 10, 3, 0.2, true},
+		{"below configured ratio", 10, 8, 0.9, false},
+		{"small folder", minDeleteCheckMessages - 1, minDeleteCheckMessages - 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newTestHandler(t, config.Mailbox{MaxDeleteRatio: tt.maxRatio, ExpungeLocalDeletes: true})
+			err := user.CreateMailbox("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var subjects []string
+			for i := 0; i < tt.messages; i++ {
+				subjects = append(subjects, fmt.Sprintf("message%d", i))
+			}
+			createMessages(t, user, "A", subjects...)
+
+			md := newTestMaildir(t)
+			err = h.CheckFolder(context.Background(), md, "A")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err := md.ListMessages("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != tt.messages {
+				t.Fatalf("folder A contains %d local messages, expected %d", len(messages), tt.messages)
+			}
+			for _, info := range messages[:tt.deleted] {
+				err = os.Remove(info.Filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = h.CheckFolder(context.Background(), md, "A")
+			if tt.refused {
+				if err == nil || !strings.Contains(err.Error(), "max_delete_ratio") {
+					t.Errorf("got error %v, expected the deletes to be refused", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			mbox, err := user.GetMailbox("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			uids, err := mbox.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, err := md.State("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := tt.deleted
+			if tt.refused {
+				expected = 0
+			}
+			if len(uids) != expected {
+				t.Errorf("%d messages are deleted on the server, expected %d", len(uids), expected)
+			}
+			if len(state.UIDs()) != tt.messages-expected {
+				t.Errorf("state contains %d messages, expected %d", len(state.UIDs()), tt.messages-expected)
+			}
+		})
+	}
+}
+
+func TestServerDeletePolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		trashFolder string // Configured trash folder
+		localFolder string // Local folder the message is kept in, if any
+	}{
+		{"default", "", "", ""},
+		{"delete", config.DeletePolicyDelete, "", ""},
+		{"trash", config.DeletePolicyTrash, "", config.DefaultTrashFolder},
+		{"configured trash", config.DeletePolicyTrash, "Deleted", "Deleted"},
+		{"keep", config.DeletePolicyKeep, "", "A"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newTestHandler(t, config.Mailbox{ServerDeletePolicy: tt.policy, TrashFolder: tt.trashFolder})
+			err := user.CreateMailbox("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			createMessages(t, user, "A", "deleted")
+
+			md := newTestMaildir(t)
+			err = h.CheckFolder(context.Background(), md, "A")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mbox, err := user.GetMailbox("A")
+			if err == nil {
+				seqSet := new(imap.SeqSet)
+				seqSet.AddNum(1)
+				err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.DeletedFlag})
+			}
+			if err == nil {
+				err = mbox.Expunge()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The message is handled once, and isn't uploaded again at later syncs
+			for i := 0; i < 2; i++ {
+				err = h.CheckFolder(context.Background(), md, "A")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, err := md.State("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uids := state.UIDs(); len(uids) != 0 {
+				t.Errorf("folder state contains UIDs %v, expected none", uids)
+			}
+
+			for _, name := range []string{"A", config.DefaultTrashFolder, "Deleted"} {
+				messages, err := md.ListMessages(name)
+				if err != nil && !os.IsNotExist(err) {
+					t.Fatal(err)
+				}
+				expected := 0
+				if name == tt.localFolder {
+					expected = 1
+				}
+				if len(messages) != expected {
+					t.Errorf("local folder %s contains %d messages, expected %d", name, len(messages), expected)
+				}
+
+				ch := make(chan mail.Info, 10)
+				err = md.ScanFolder(context.Background(), name, ch)
+				close(ch)
+				if err != nil && !os.IsNotExist(err) {
+					t.Fatal(err)
+				}
+				for info := range ch {
+					t.Errorf("message %s would be uploaded to folder %s", info.Filename, name)
+				}
+			}
+		})
+	}
+}
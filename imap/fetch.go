@@ -6,7 +6,9 @@ package imap
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"os"
 
 	"github.com/emersion/go-imap"
 	"github.com/schollz/progressbar/v3"
@@ -14,56 +16,118 @@ import (
 	"github.com/yzzyx/imap-sync/maildir"
 )
 
-// getMessage downloads a message from the server from a mailbox, and stores it in a maildir
-func (h *Handler) getMessage(ctx context.Context, md *maildir.Maildir, folderName string, uidValidity uint32, uid uint32) error {
+// Limits for the number of messages, and the total size of the messages, downloaded with a single UID FETCH.
+// Messages are written to disk as they arrive, so the limits mainly control how much work is
+// repeated if a download is interrupted
+const (
+	downloadBatchSize  = 500
+	downloadBatchBytes = 50 * 1024 * 1024
+)
+
+// downloadBatches splits a list of messages into batches that are fetched with a single command
+func downloadBatches(messages []remoteMessage) [][]remoteMessage {
+	var batches [][]remoteMessage
+	var batch []remoteMessage
+	var size uint64
+	for _, rm := range messages {
+		if len(batch) > 0 && (len(batch) >= downloadBatchSize || size+uint64(rm.Size) > downloadBatchBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, rm)
+		size += uint64(rm.Size)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// getMessages downloads a batch of messages from the server, and stores them in a maildir.
+// Each message is written to disk as soon as it has been received
+func (h *Handler) getMessages(ctx context.Context, md *maildir.Maildir, folderName string, uidValidity uint32, batch []remoteMessage, progress *progressbar.ProgressBar) error {
 	// Download whole body
 	section := &imap.BodySectionName{
 		Peek: true, // Do not update seen-flags
 	}
-	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags}
+	items := []imap.FetchItem{imap.FetchUid, section.FetchItem(), imap.FetchFlags, imap.FetchInternalDate}
 	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+	for _, rm := range batch {
+		seqSet.AddNum(rm.UID)
+	}
 
-	messages := make(chan *imap.Message)
-	done := make(chan error)
+	// Keep the buffer small, so that only a few messages are kept in memory at a time
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
 	go func() {
 		done <- h.client.UidFetch(seqSet, items, messages)
 	}()
 
-	msg := <-messages
-	if msg == nil {
-		return errors.New("server didn't return message")
-	}
+	// Note that we must keep reading until the channel is closed, even if an error occurs
+	var err error
+	for msg := range messages {
+		if err != nil {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			continue
+		}
 
-	r := msg.GetBody(section)
-	if r == nil {
-		return errors.New("server didn't return message body")
-	}
+		if msg.Uid == 0 {
+			err = errors.New("server did not return UID")
+			continue
+		}
 
-	err := <-done
-	if err != nil {
-		return err
+		r := msg.GetBody(section)
+		if r == nil {
+			err = fmt.Errorf("server didn't return message body for UID %d", msg.Uid)
+			continue
+		}
+
+		info := mail.Info{
+			FolderName:  folderName,
+			UIDValidity: int(uidValidity),
+			UID:         int(msg.Uid),
+			Flags:       mail.FlagsFromIMAP(msg.Flags),
+		}
+		info, err = md.AddMessage(info, r)
+		if err == nil && !msg.InternalDate.IsZero() {
+			// Let the modification time reflect when the message was received, like on the server
+			err = os.Chtimes(info.Filename, msg.InternalDate, msg.InternalDate)
+		}
+		progress.Add(1)
 	}
 
-	info := mail.Info{
-		FolderName:  folderName,
-		UIDValidity: int(uidValidity),
-		UID:         int(uid),
-		Flags:       mail.FlagsFromIMAP(msg.Flags),
+	if fetchErr := <-done; err == nil {
+		err = fetchErr
 	}
-	_, err = md.AddMessage(info, r)
 	return err
 }
 
 // mailboxFetchMessages checks for any new messages in mailbox
 func (h *Handler) mailboxFetchMessages(ctx context.Context, md *maildir.Maildir, folderName string) error {
-	mbox, err := h.client.Select(folderName, false)
+	state, err := md.State(folderName)
 	if err != nil {
 		return err
 	}
 
-	if mbox.Messages == 0 {
-		return nil
+	var mbox *imap.MailboxStatus
+	var changed *changes
+	var server *serverMessages
+	if prev, ok := h.collectedMessages(folderName); ok {
+		// The messages on the server were fetched when we looked for removed messages,
+		// so the folder only has to be selected again
+		mbox, err = h.client.Select(folderName, false)
+		if err == nil && mbox.UidValidity == prev.uidValidity {
+			changed, server = prev.changed, prev.server
+		}
+	} else if h.condstore {
+		mbox, changed, err = h.selectChanged(folderName, uint32(state.UIDValidity()), state.HighestModSeq())
+	} else {
+		mbox, err = h.client.Select(folderName, false)
+	}
+	if err != nil {
+		return err
 	}
 
 	// Search for new UID's
@@ -75,17 +139,56 @@ func (h *Handler) mailboxFetchMessages(ctx context.Context, md *maildir.Maildir,
 	if err != nil {
 		return err
 	}
+	lastSeenUID = uint32(uid)
 	if uidValidity > 0 && int(mbox.UidValidity) != uidValidity {
-		return errors.New("UID validity for mailbox does not match our value - not handled")
+		lastSeenUID, err = h.recoverUIDValidity(ctx, md, folderName, mbox)
+		if err != nil {
+			return fmt.Errorf("cannot recover from UID validity change in folder %s: %w", folderName, err)
+		}
+	}
+
+	// After recovering from a UID validity change, we might know about messages above lastSeenUID
+	knownUID := lastSeenUID
+	if uids := state.UIDs(); len(uids) > 0 && uint32(uids[len(uids)-1]) > knownUID {
+		knownUID = uint32(uids[len(uids)-1])
+	}
+
+	// Fetch the current flags of all messages we already know about
+	if server == nil {
+		server, err = h.fetchServerMessages(mbox, changed, state, knownUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove local copies of messages that have been expunged on the server
+	err = h.syncExpunged(ctx, md, folderName, server)
+	if err != nil {
+		return err
+	}
+
+	// Propagate messages that have been deleted locally to the server
+	err = h.syncLocalDeletes(ctx, md, folderName, server)
+	if err != nil {
+		return err
+	}
+
+	// Synchronize flags for messages we already know about
+	err = h.syncFlags(ctx, md, folderName, mbox.UidValidity, server)
+	if err != nil {
+		return err
+	}
+
+	if mbox.Messages == 0 {
+		return h.saveModSeq(folderName, state, changed)
 	}
-	lastSeenUID = uint32(uid)
 
 	// Note that we search from lastSeenUID to MAX, instead of
 	//   lastSeenUID to '*', because the latter always returns at least one entry
 	seqSet.AddRange(lastSeenUID+1, math.MaxUint32)
 
-	// Fetch envelope information (contains messageid, and UID, which we'll use to fetch the body
-	items := []imap.FetchItem{imap.FetchUid}
+	// Fetch UID and size of the new messages, which are used to split the download into batches
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}
 
 	messages := make(chan *imap.Message, 100)
 	errchan := make(chan error, 1)
@@ -96,7 +199,7 @@ func (h *Handler) mailboxFetchMessages(ctx context.Context, md *maildir.Maildir,
 		}
 	}()
 
-	uidList := []uint32{}
+	var newMessages []remoteMessage
 	for msg := range messages {
 		if msg == nil {
 			// We're done
@@ -110,7 +213,12 @@ func (h *Handler) mailboxFetchMessages(ctx context.Context, md *maildir.Maildir,
 		if msg.Uid > lastSeenUID {
 			lastSeenUID = msg.Uid
 		}
-		uidList = append(uidList, msg.Uid)
+
+		// Skip messages we already have, e.g. after recovering from a UID validity change
+		if _, ok := state.Message(int(msg.Uid)); ok {
+			continue
+		}
+		newMessages = append(newMessages, remoteMessage{UID: msg.Uid, Size: msg.Size})
 	}
 
 	// Check if an error occurred while fetching data
@@ -120,15 +228,34 @@ func (h *Handler) mailboxFetchMessages(ctx context.Context, md *maildir.Maildir,
 	default:
 	}
 
-	progress := progressbar.NewOptions(len(uidList), progressbar.OptionSetDescription(folderName))
-	for _, uid := range uidList {
-		progress.Add(1)
-
-		err = h.getMessage(ctx, md, folderName, mbox.UidValidity, uid)
+	// Messages that have been moved here from another folder on the server don't have to be downloaded again
+	newMessages, err = h.relocateMoved(md, folderName, mbox.UidValidity, newMessages)
+	if err != nil {
+		return err
+	}
 
+	// Progress bars drawn by several connections at the same time would garble each other
+	progress := progressbar.NewOptions(len(newMessages), progressbar.OptionSetDescription(folderName),
+		progressbar.OptionSetVisibility(!h.parallel))
+	for _, batch := range downloadBatches(newMessages) {
+		err = h.getMessages(ctx, md, folderName, mbox.UidValidity, batch, progress)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return h.saveModSeq(folderName, state, changed)
+}
+
+// saveModSeq stores the highest mod-sequence reported when the folder was selected,
+// so that only changes made after this point are fetched at the next sync.
+// If messages removed from the folder are waiting to be matched against other folders,
+// it's saved once they have been handled instead
+func (h *Handler) saveModSeq(folderName string, state *maildir.FolderState, c *changes) error {
+	if c == nil {
+		return nil
+	}
+	if h.moves != nil && h.moves.deferModSeq(folderName, c.HighestModSeq) {
+		return nil
+	}
+	return state.SetHighestModSeq(c.HighestModSeq)
 }
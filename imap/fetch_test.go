@@ -0,0 +1,103 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/config"
+)
+
+func TestDownloadBatches(t *testing.T) {
+	// sizedMessages returns 'count' messages of 'size' bytes each
+	sizedMessages := func(count int, size uint32) []remoteMessage {
+		messages := make([]remoteMessage, count)
+		for i := range messages {
+			messages[i] = remoteMessage{UID: uint32(i + 1), Size: size}
+		}
+		return messages
+	}
+
+	tests := []struct {
+		name     string
+		messages []remoteMessage
+		expected []int // Number of messages in each batch
+	}{
+		{"no messages", nil, nil},
+		{"single message", sizedMessages(1, 100), []int{1}},
+		{"full batch", sizedMessages(downloadBatchSize, 100), []int{downloadBatchSize}},
+		{"one more than a batch", sizedMessages(downloadBatchSize+1, 100), []int{downloadBatchSize, 1}},
+		{"two full batches", sizedMessages(2*downloadBatchSize, 100), []int{downloadBatchSize, downloadBatchSize}},
+		{"exactly max bytes", sizedMessages(2, downloadBatchBytes/2), []int{2}},
+		{"one byte over max bytes", append(sizedMessages(2, downloadBatchBytes/2), sizedMessages(1, 1)...), []int{2, 1}},
+		{"message larger than max bytes", sizedMessages(2, downloadBatchBytes+1), []int{1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches := downloadBatches(tt.messages)
+			if len(batches) != len(tt.expected) {
+				t.Fatalf("got %d batches, expected %d", len(batches), len(tt.expected))
+			}
+
+			var n int
+			for i, batch := range batches {
+				if len(batch) != tt.expected[i] {
+					t.Errorf("batch %d contains %d messages, expected %d", i, len(batch), tt.expected[i])
+				}
+				// Messages must be kept in order, without gaps
+				for _, rm := range batch {
+					if rm != tt.messages[n] {
+						t.Fatalf("batch %d contains %+v, expected %+v", i, rm, tt.messages[n])
+					}
+					n++
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadInternalDate(t *testing.T) {
+	h, user := newTestHandler(t, config.Mailbox{})
+	err := user.CreateMailbox("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2019, time.March, 14, 15, 9, 26, 0, time.UTC)
+	err = mbox.CreateMessage([]string{imap.SeenFlag}, date, bytes.NewBufferString("Subject: dated\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := newTestMaildir(t)
+	err = h.CheckFolder(context.Background(), md, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := md.ListMessages("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("folder A contains %d local messages, expected 1", len(messages))
+	}
+	st, err := os.Stat(messages[0].Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.ModTime().Equal(date) {
+		t.Errorf("message has modification time %v, expected INTERNALDATE %v", st.ModTime(), date)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/yzzyx/imap-sync/config"
+)
+
+// folderRule includes or excludes all folders matching a pattern
+type folderRule struct {
+	include bool
+	pattern string
+	re      *regexp.Regexp // nil if the pattern is a plain folder name
+}
+
+// folderFilter decides which folders are synchronized
+type folderFilter struct {
+	rules      []folderRule
+	hasInclude bool // If there are include rules, folders not matching any rule are excluded
+}
+
+// newFolderFilter compiles the folder rules of a mailbox.
+// 'delimiter' is the hierarchy delimiter used by the server, which '%' doesn't match
+func newFolderFilter(folders config.Folders, delimiter string) (*folderFilter, error) {
+	f := &folderFilter{}
+
+	add := func(pattern string, include bool) error {
+		rule, err := newFolderRule(pattern, include, delimiter)
+		if err != nil {
+			return err
+		}
+		f.rules = append(f.rules, rule)
+		f.hasInclude = f.hasInclude || include
+		return nil
+	}
+
+	for _, r := range folders.Rules {
+		if (r.Include == "") == (r.Exclude == "") {
+			return nil, errors.New("each folder rule must have either include or exclude set")
+		}
+		var err error
+		if r.Include != "" {
+			err = add(r.Include, true)
+		} else {
+			err = add(r.Exclude, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range folders.Exclude {
+		if err := add(pattern, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range folders.Include {
+		if err := add(pattern, true); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// newFolderRule parses a folder pattern, which is either a regular expression enclosed in '/',
+// a wildcard pattern, or a plain folder name. Any name containing a wildcard is a pattern
+func newFolderRule(pattern string, include bool, delimiter string) (folderRule, error) {
+	rule := folderRule{include: include, pattern: pattern}
+
+	var expr string
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expr = pattern[1 : len(pattern)-1]
+	} else if strings.ContainsAny(pattern, "*%?") {
+		expr = globToRegexp(pattern, delimiter)
+	} else {
+		return rule, nil
+	}
+
+	// Patterns always have to match the complete folder name
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return rule, fmt.Errorf("invalid folder pattern %s: %w", pattern, err)
+	}
+	rule.re = re
+	return rule, nil
+}
+
+// globToRegexp converts a wildcard pattern to a regular expression.
+// The wildcards are the same as in the IMAP LIST command, where '*' matches any characters
+// and '%' matches any characters except the hierarchy delimiter. '?' matches a single character
+func globToRegexp(pattern string, delimiter string) string {
+	var sb strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '%':
+			if delimiter == "" {
+				sb.WriteString(".*")
+			} else {
+				sb.WriteString("[^" + regexp.QuoteMeta(delimiter) + "]*")
+			}
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
+
+// match returns true if the rule applies to a folder
+func (r folderRule) match(name string) bool {
+	if r.re != nil {
+		return r.re.MatchString(name)
+	}
+	return r.pattern == name
+}
+
+// included returns true if a folder should be synchronized
+func (f *folderFilter) included(name string) bool {
+	for _, r := range f.rules {
+		if r.match(name) {
+			return r.include
+		}
+	}
+	return !f.hasInclude
+}
+
+// names returns the folders that are included by name rather than by a pattern,
+// which are expected to exist on the server
+func (f *folderFilter) names() []string {
+	var names []string
+	for _, r := range f.rules {
+		if r.include && r.re == nil {
+			names = append(names, r.pattern)
+		}
+	}
+	return names
+}
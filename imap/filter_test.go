@@ -0,0 +1,94 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"testing"
+
+	"github.com/yzzyx/imap-sync/config"
+)
+
+func TestFolderFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		folders  config.Folders
+		included []string
+		excluded []string
+	}{
+		{
+			name:     "no rules",
+			included: []string{"INBOX", "Lists/Go"},
+		},
+		{
+			name:     "names",
+			folders:  config.Folders{Include: []string{"INBOX", "Lists"}},
+			included: []string{"INBOX", "Lists"},
+			excluded: []string{"Lists/Go", "inbox"},
+		},
+		{
+			name:     "wildcards",
+			folders:  config.Folders{Include: []string{"Lists/*", "Archive/%", "Mail?"}},
+			included: []string{"Lists/Go", "Lists/Go/Dev", "Archive/2020", "Mail1"},
+			excluded: []string{"Lists", "Archive/2020/01", "Mail", "Mail12"},
+		},
+		{
+			// Names containing a wildcard are patterns, and a regular expression is needed to match them exactly
+			name:     "wildcard in name",
+			folders:  config.Folders{Include: []string{"100%", "/50%/"}},
+			included: []string{"100%", "1000", "50%"},
+			excluded: []string{"500", "100/0"},
+		},
+		{
+			name:     "regular expression",
+			folders:  config.Folders{Exclude: []string{"/.*[Dd]rafts?/"}},
+			included: []string{"INBOX", "Drafts/Old"},
+			excluded: []string{"Drafts", "Lists/draft"},
+		},
+		{
+			name: "ordered rules",
+			folders: config.Folders{
+				Rules:   []config.FolderRule{{Exclude: "Lists/Noisy"}, {Include: "Lists/*"}},
+				Include: []string{"INBOX"},
+			},
+			included: []string{"INBOX", "Lists/Go"},
+			excluded: []string{"Lists/Noisy", "Sent"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newFolderFilter(tt.folders, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range tt.included {
+				if !f.included(name) {
+					t.Errorf("folder %q is excluded, expected it to be included", name)
+				}
+			}
+			for _, name := range tt.excluded {
+				if f.included(name) {
+					t.Errorf("folder %q is included, expected it to be excluded", name)
+				}
+			}
+		})
+	}
+}
+
+func TestFolderFilterDecodesNames(t *testing.T) {
+	h, _ := newTestHandler(t, config.Mailbox{
+		Folders: config.Folders{
+			Include:     []string{"INBOX", "Entw&APw-rfe"},
+			Rules:       []config.FolderRule{{Exclude: "&BB4EQgQ,BEAEMAQyBDsENQQ9BD0ESwQ1-/*"}},
+			WarnMissing: true,
+		},
+	})
+
+	if !h.FolderIncluded("Entwürfe") {
+		t.Errorf("folder Entwürfe is excluded, expected it to be included")
+	}
+	if h.FolderIncluded("Отправленные/Old") {
+		t.Errorf("folder Отправленные/Old is included, expected it to be excluded")
+	}
+}
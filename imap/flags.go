@@ -0,0 +1,220 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// serverMessages describes the messages on the server that we've previously synchronized.
+// If 'changedOnly' is set, 'flags' only contains messages that have changed since the
+// last sync, and 'vanished' contains the messages that have been expunged since then.
+// Otherwise, 'flags' contains every message on the server.
+type serverMessages struct {
+	flags       map[int][]string
+	vanished    map[int]bool
+	changedOnly bool
+}
+
+// exists returns true if the message still exists on the server
+func (s *serverMessages) exists(uid int) bool {
+	if s.changedOnly {
+		return !s.vanished[uid]
+	}
+	_, ok := s.flags[uid]
+	return ok
+}
+
+// currentFlags returns the flags of a message on the server.
+// If the message hasn't changed since the last sync, 'synced' is returned
+func (s *serverMessages) currentFlags(uid int, synced []string) []string {
+	if flags, ok := s.flags[uid]; ok {
+		return flags
+	}
+	return synced
+}
+
+// fetchServerMessages returns the state of all messages on the server up to and including 'lastUID'.
+// If CONDSTORE is available, and we know the mod-sequence from the last sync,
+// we only fetch the messages that have changed since then.
+func (h *Handler) fetchServerMessages(mbox *imap.MailboxStatus, c *changes, state *maildir.FolderState, lastUID uint32) (*serverMessages, error) {
+	s := &serverMessages{
+		flags:    make(map[int][]string),
+		vanished: make(map[int]bool),
+	}
+	if mbox.Messages == 0 || lastUID == 0 {
+		return s, nil
+	}
+
+	var err error
+	modSeq := state.HighestModSeq()
+	if c == nil || c.HighestModSeq == 0 || modSeq == 0 {
+		s.flags, err = h.fetchFlags(lastUID)
+		return s, err
+	}
+	s.changedOnly = true
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, lastUID)
+
+	changed := c.Messages
+	if h.qresync {
+		// Changes and expunged messages have already been reported when the mailbox was selected
+		for _, uid := range state.UIDs() {
+			if c.Vanished != nil && c.Vanished.Contains(uint32(uid)) {
+				s.vanished[uid] = true
+			}
+		}
+	} else {
+		changed, err = h.fetchChanged(seqSet, modSeq)
+		if err != nil {
+			return nil, err
+		}
+
+		// Expunges can't be detected through CONDSTORE, so we compare the UIDs on the server to ours
+		criteria := imap.NewSearchCriteria()
+		criteria.Uid = seqSet
+		uids, err := h.client.UidSearch(criteria)
+		if err != nil {
+			return nil, err
+		}
+		existing := make(map[int]bool)
+		for _, uid := range uids {
+			existing[int(uid)] = true
+		}
+		for _, uid := range state.UIDs() {
+			if !existing[uid] {
+				s.vanished[uid] = true
+			}
+		}
+	}
+
+	for _, msg := range changed {
+		if msg.Uid == 0 || msg.Uid > lastUID {
+			continue
+		}
+		s.flags[int(msg.Uid)] = mail.FlagsFromIMAP(msg.Flags)
+	}
+	return s, nil
+}
+
+// fetchFlags returns the current flags for all messages in the selected mailbox
+// with UIDs up to and including 'lastUID'
+func (h *Handler) fetchFlags(lastUID uint32) (map[int][]string, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, lastUID)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+
+	messages := make(chan *imap.Message, 100)
+	errchan := make(chan error, 1)
+	go func() {
+		if err := h.client.UidFetch(seqSet, items, messages); err != nil {
+			errchan <- err
+		}
+	}()
+
+	remoteFlags := make(map[int][]string)
+	for msg := range messages {
+		if msg == nil {
+			// We're done
+			break
+		}
+		if msg.Uid == 0 {
+			continue
+		}
+		remoteFlags[int(msg.Uid)] = mail.FlagsFromIMAP(msg.Flags)
+	}
+
+	// Check if an error occurred while fetching data
+	select {
+	case err := <-errchan:
+		return nil, err
+	default:
+	}
+	return remoteFlags, nil
+}
+
+// storeFlags updates the flags of a message on the server.
+// Flags are added and removed individually, so that any keywords
+// we don't know about are left untouched
+func (h *Handler) storeFlags(uid uint32, oldFlags, newFlags []string) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	added, removed := mail.DiffFlags(oldFlags, newFlags)
+	ops := []struct {
+		op    imap.FlagsOp
+		flags []string
+	}{
+		{imap.AddFlags, mail.FlagsToIMAP(added)},
+		{imap.RemoveFlags, mail.FlagsToIMAP(removed)},
+	}
+
+	for _, o := range ops {
+		if len(o.flags) == 0 {
+			continue
+		}
+
+		var flags []interface{}
+		for _, f := range o.flags {
+			flags = append(flags, f)
+		}
+		err := h.client.UidStore(seqSet, imap.FormatFlagsOp(o.op, true), flags, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFlags compares the flags of all messages that have previously been synchronized
+// with the flags on the server, and propagates changes in either direction.
+// Changes are detected by comparing both sides to the flags recorded at the last sync.
+func (h *Handler) syncFlags(ctx context.Context, md *maildir.Maildir, folderName string, uidValidity uint32, server *serverMessages) error {
+	state, err := md.State(folderName)
+	if err != nil {
+		return err
+	}
+
+	messages, err := md.SyncedMessages(folderName)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range messages {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if !server.exists(info.UID) {
+			continue
+		}
+
+		synced, hasBase := state.Message(info.UID)
+		base := synced.Flags
+		remote := server.currentFlags(info.UID, base)
+		flags := mail.MergeFlags(base, info.Flags, remote)
+
+		if !mail.FlagsEqual(flags, remote) {
+			err = h.storeFlags(uint32(info.UID), remote, flags)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !hasBase || !mail.FlagsEqual(flags, info.Flags) || !mail.FlagsEqual(flags, base) {
+			info.UIDValidity = int(uidValidity)
+			info.Flags = flags
+			_, err = md.RenameMessage(info)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/mail"
+)
+
+func TestSyncFlags(t *testing.T) {
+	tests := []struct {
+		name           string
+		local          []string // Flags set locally
+		remoteAdd      []string // Flags added on the server
+		remoteDel      []string // Flags removed on the server
+		expectedLocal  []string // Expected local flags afterwards
+		expectedRemote []string // Expected flags on the server afterwards
+	}{
+		{"unchanged", []string{mail.FlagSeen}, nil, nil,
+			[]string{mail.FlagSeen}, []string{imap.SeenFlag}},
+		{"changed locally", []string{mail.FlagFlagged, mail.FlagSeen}, nil, nil,
+			[]string{mail.FlagFlagged, mail.FlagSeen}, []string{imap.FlaggedFlag, imap.SeenFlag}},
+		{"changed on server", []string{mail.FlagSeen}, []string{imap.AnsweredFlag}, []string{imap.SeenFlag},
+			[]string{mail.FlagReplied}, []string{imap.AnsweredFlag}},
+		{"same change on both sides", []string{mail.FlagFlagged, mail.FlagSeen}, []string{imap.FlaggedFlag}, nil,
+			[]string{mail.FlagFlagged, mail.FlagSeen}, []string{imap.FlaggedFlag, imap.SeenFlag}},
+		{"different changes on each side", nil, []string{imap.FlaggedFlag}, nil,
+			[]string{mail.FlagFlagged}, []string{imap.FlaggedFlag}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newTestHandler(t, config.Mailbox{})
+			err := user.CreateMailbox("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mbox, err := user.GetMailbox("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Keywords that can't be stored in the maildir must be left alone on the server
+			err = mbox.CreateMessage([]string{imap.SeenFlag, "$Label1"}, time.Now(), bytes.NewBufferString("Subject: flags\r\n\r\nhello\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			md := newTestMaildir(t)
+			err = h.CheckFolder(context.Background(), md, "A")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err := md.ListMessages("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 {
+				t.Fatalf("folder A contains %d local messages, expected 1", len(messages))
+			}
+			filename := messages[0].Filename
+			err = os.Rename(filename, filename[:strings.Index(filename, ":2,")+3]+strings.Join(tt.local, ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seqSet := new(imap.SeqSet)
+			seqSet.AddNum(1)
+			if len(tt.remoteAdd) > 0 {
+				err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, tt.remoteAdd)
+			}
+			if err == nil && len(tt.remoteDel) > 0 {
+				err = mbox.UpdateMessagesFlags(true, seqSet, imap.RemoveFlags, tt.remoteDel)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = h.CheckFolder(context.Background(), md, "A")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err = md.ListMessages("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 || !mail.FlagsEqual(messages[0].Flags, tt.expectedLocal) {
+				t.Errorf("got local messages %v, expected a single message with flags %v", messages, tt.expectedLocal)
+			}
+
+			ch := make(chan *imap.Message, 1)
+			err = mbox.ListMessages(true, seqSet, []imap.FetchItem{imap.FetchFlags}, ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := <-ch
+			expected := append([]string{"$Label1"}, tt.expectedRemote...)
+			sort.Strings(expected)
+			sort.Strings(msg.Flags)
+			if strings.Join(msg.Flags, " ") != strings.Join(expected, " ") {
+				t.Errorf("server has flags %v, expected %v", msg.Flags, expected)
+			}
+		})
+	}
+}
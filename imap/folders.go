@@ -0,0 +1,346 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// folderSync keeps track of the folders on both sides while the folder structure is synchronized
+type folderSync struct {
+	h  *Handler
+	md *maildir.Maildir
+
+	known  map[string]int  // Folders that existed on both sides at the last sync, and their UID validity
+	server map[string]bool // Folders on the server
+	local  map[string]bool // Local folders
+}
+
+// SyncFolders synchronizes the folder structure between the server and the maildir.
+// Folders that only exist on one side are created on the other side.
+// Renames are detected by comparing the UID validity of new folders with folders that have disappeared,
+// and are applied to the other side. Folders that have been deleted on one side are handled
+// according to the folder_delete policy.
+func (h *Handler) SyncFolders(ctx context.Context, md *maildir.Maildir) error {
+	policy := h.mailbox.FolderDeletePolicy
+	if policy == "" {
+		policy = config.DeletePolicyKeep
+	}
+	if policy != config.DeletePolicyKeep && policy != config.DeletePolicyDelete {
+		return fmt.Errorf("unknown folder_delete policy %q", policy)
+	}
+
+	var err error
+	fs := &folderSync{
+		h:  h,
+		md: md,
+	}
+
+	var sameLayout bool
+	fs.known, sameLayout, err = md.KnownFolders()
+	if err != nil {
+		return err
+	}
+	if !sameLayout {
+		// Local folders might be stored in other directories than before,
+		// in which case they would look like they had been deleted
+		log.Printf("maildir layout or folder map has changed since the last sync, folder renames and deletions are not synchronized")
+		fs.known = make(map[string]int)
+	}
+
+	err = h.Retry(ctx, "listing folders", fs.listServer)
+	if err != nil {
+		return err
+	}
+
+	err = fs.listLocal()
+	if err != nil {
+		return err
+	}
+
+	// Folders created by other tools might use the encoded name, e.g. "Entw&APw-rfe"
+	for _, name := range sortedKeys(fs.local) {
+		decoded := decodeFolderName(name)
+		if decoded == name || fs.server[name] || !fs.server[decoded] || fs.local[decoded] {
+			continue
+		}
+
+		log.Printf("local folder %s is named in modified UTF-7, renaming it to %s", name, decoded)
+		err = md.RenameFolder(name, decoded)
+		if err != nil {
+			return err
+		}
+		delete(fs.local, name)
+		fs.local[decoded] = true
+	}
+
+	if policy == config.DeletePolicyDelete {
+		err = fs.checkLocalDeletes()
+		if err != nil {
+			return err
+		}
+	}
+
+	var knownNames []string
+	for name := range fs.known {
+		knownNames = append(knownNames, name)
+	}
+	sort.Strings(knownNames)
+
+	for _, name := range knownNames {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		uidValidity := fs.known[name]
+		switch {
+		case fs.server[name] && fs.local[name]:
+			continue
+		case fs.server[name]:
+			err = fs.missingLocally(name, uidValidity, policy)
+		case fs.local[name]:
+			err = fs.missingOnServer(name, uidValidity, policy)
+		}
+		if err != nil {
+			return err
+		}
+		delete(fs.known, name)
+	}
+
+	// Create folders that only exist on one side
+	for _, name := range sortedKeys(fs.local) {
+		if fs.server[name] {
+			continue
+		}
+
+		// If the folder contains messages that were synchronized earlier,
+		// they must be uploaded again, since they don't exist in the new folder
+		err = md.DetachFolder(name)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("creating folder %s on server", name)
+		err = h.client.Create(name)
+		if err != nil {
+			return fmt.Errorf("cannot create folder %s on server: %w", name, err)
+		}
+		fs.server[name] = true
+	}
+
+	for name := range fs.server {
+		err = md.CreateFolder(name)
+		if err != nil {
+			return err
+		}
+		fs.local[name] = true
+	}
+
+	// All folders now exist on both sides
+	known := make(map[string]int)
+	for name := range fs.server {
+		state, err := md.State(name)
+		if err != nil {
+			return err
+		}
+		known[name] = state.UIDValidity()
+	}
+	return md.SetKnownFolders(known)
+}
+
+// listServer lists the folders on the server
+func (fs *folderSync) listServer() error {
+	folders, err := fs.h.listFolders()
+	if err != nil {
+		return err
+	}
+
+	fs.server = make(map[string]bool)
+	for _, name := range folders {
+		fs.server[name] = true
+	}
+	return nil
+}
+
+// listLocal lists the local folders
+func (fs *folderSync) listLocal() error {
+	folders, err := fs.md.Folders()
+	if err != nil {
+		return err
+	}
+
+	fs.local = make(map[string]bool)
+	for _, name := range folders {
+		if fs.h.FolderIncluded(name) {
+			fs.local[name] = true
+		}
+	}
+	return nil
+}
+
+// checkLocalDeletes returns an error if an unusually large part of the folders have been deleted locally,
+// in which case we assume that something is wrong with the maildir, instead of deleting them on the server
+func (fs *folderSync) checkLocalDeletes() error {
+	if len(fs.known) == 0 {
+		return nil
+	}
+
+	var deleted int
+	for name, uidValidity := range fs.known {
+		if !fs.server[name] || fs.local[name] {
+			continue
+		}
+		newName, err := fs.findLocalRename(uidValidity)
+		if err != nil {
+			return err
+		}
+		if newName == "" {
+			deleted++
+		}
+	}
+
+	if float64(deleted)/float64(len(fs.known)) > fs.h.maxDeleteRatio() {
+		return fmt.Errorf("%d of %d folders have been deleted locally, which exceeds max_delete_ratio - refusing to delete them on the server",
+			deleted, len(fs.known))
+	}
+	return nil
+}
+
+// missingLocally handles a folder that has been renamed or deleted locally
+func (fs *folderSync) missingLocally(name string, uidValidity int, policy string) error {
+	newName, err := fs.findLocalRename(uidValidity)
+	if err != nil {
+		return err
+	}
+	if newName != "" {
+		log.Printf("folder %s was renamed locally to %s, renaming it on server", name, newName)
+		err = fs.h.client.Rename(name, newName)
+		if err != nil {
+			return fmt.Errorf("cannot rename folder %s on server: %w", name, err)
+		}
+
+		// Subfolders are renamed by the server as well
+		return fs.listServer()
+	}
+
+	if policy == config.DeletePolicyDelete && !isInbox(name) {
+		log.Printf("folder %s was deleted locally, deleting it on server", name)
+		err = fs.h.client.Delete(name)
+		if err != nil {
+			return fmt.Errorf("cannot delete folder %s on server: %w", name, err)
+		}
+		delete(fs.server, name)
+		return fs.md.RemoveFolder(name)
+	}
+
+	log.Printf("folder %s was deleted locally, downloading it again", name)
+	return fs.md.RemoveFolder(name)
+}
+
+// missingOnServer handles a folder that has been renamed or deleted on the server
+func (fs *folderSync) missingOnServer(name string, uidValidity int, policy string) error {
+	newName, err := fs.findServerRename(uidValidity)
+	if err != nil {
+		return err
+	}
+	if newName != "" {
+		log.Printf("folder %s was renamed to %s on server, renaming local folder", name, newName)
+		err = fs.md.RenameFolder(name, newName)
+		if err != nil {
+			return err
+		}
+
+		// Depending on the layout, subfolders might have been moved as well
+		return fs.listLocal()
+	}
+
+	if policy == config.DeletePolicyDelete {
+		log.Printf("folder %s was deleted on server, deleting local folder", name)
+		err = fs.md.RemoveFolder(name)
+		if err != nil {
+			return err
+		}
+		delete(fs.local, name)
+		return nil
+	}
+
+	log.Printf("folder %s was deleted on server, uploading it again", name)
+	return nil
+}
+
+// findLocalRename looks for a new local folder with the same UID validity as a folder that has disappeared
+func (fs *folderSync) findLocalRename(uidValidity int) (string, error) {
+	if uidValidity == 0 {
+		return "", nil
+	}
+
+	var match string
+	for _, name := range sortedKeys(fs.local) {
+		if _, ok := fs.known[name]; ok || fs.server[name] {
+			continue
+		}
+
+		state, err := fs.md.State(name)
+		if err != nil {
+			return "", err
+		}
+		if state.UIDValidity() == uidValidity {
+			if match != "" {
+				// Ambiguous, so we can't tell which one it is
+				return "", nil
+			}
+			match = name
+		}
+	}
+	return match, nil
+}
+
+// findServerRename looks for a new folder on the server with the same UID validity as a folder that has disappeared
+func (fs *folderSync) findServerRename(uidValidity int) (string, error) {
+	if uidValidity == 0 {
+		return "", nil
+	}
+
+	var match string
+	for _, name := range sortedKeys(fs.server) {
+		if _, ok := fs.known[name]; ok || fs.local[name] {
+			continue
+		}
+
+		status, err := fs.h.client.Status(name, []imap.StatusItem{imap.StatusUidValidity})
+		if err != nil {
+			return "", err
+		}
+		if int(status.UidValidity) == uidValidity {
+			if match != "" {
+				// Ambiguous, so we can't tell which one it is
+				return "", nil
+			}
+			match = name
+		}
+	}
+	return match, nil
+}
+
+// isInbox returns true if 'name' refers to the INBOX, which can't be deleted
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
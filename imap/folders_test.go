@@ -0,0 +1,549 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/literal"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// serverFolders returns the names of all folders on the server
+func serverFolders(t *testing.T, h *Handler) []string {
+	t.Helper()
+
+	folders, err := h.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range folders {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSyncFoldersRenamesEncodedFolder(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  []string // Folders on the server, besides INBOX
+		local   string   // Local folder, named in modified UTF-7
+		renamed string   // Expected local name after the sync
+		folders []string // Expected folders on both sides after the sync, besides INBOX
+	}{
+		{
+			name:    "encoded name",
+			server:  []string{"Entwürfe"},
+			local:   "Entw&APw-rfe",
+			renamed: "Entwürfe",
+			folders: []string{"Entwürfe"},
+		},
+		{
+			name:    "cyrillic",
+			server:  []string{"Отправленные"},
+			local:   "&BB4EQgQ,BEAEMAQyBDsENQQ9BD0ESwQ1-",
+			renamed: "Отправленные",
+			folders: []string{"Отправленные"},
+		},
+		{
+			// The decoded name doesn't exist on the server, so the local name is used as-is
+			name:    "not on server",
+			local:   "Entw&APw-rfe",
+			renamed: "Entw&APw-rfe",
+			folders: []string{"Entw&APw-rfe"},
+		},
+		{
+			// Both names exist on the server, so the local folder is the one with the literal name
+			name:    "both names on server",
+			server:  []string{"Entwürfe", "Entw&APw-rfe"},
+			local:   "Entw&APw-rfe",
+			renamed: "Entw&APw-rfe",
+			folders: []string{"Entw&APw-rfe", "Entwürfe"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newTestHandler(t, config.Mailbox{})
+			for _, name := range tt.server {
+				err := user.CreateMailbox(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dir, err := ioutil.TempDir("", "imap-sync-folders")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			md, err := maildir.New(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer md.Close()
+
+			err = md.CreateFolder(tt.local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(filepath.Join(dir, tt.local, "cur", "1.local.host:2,S"), []byte("Subject: test\r\n\r\ntest\r\n"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = h.SyncFolders(context.Background(), md)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := append([]string{"INBOX"}, tt.folders...)
+			sort.Strings(expected)
+			folders, err := md.Folders()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(folders)
+			if strings.Join(folders, ",") != strings.Join(expected, ",") {
+				t.Errorf("got local folders %v, expected %v", folders, expected)
+			}
+
+			messages, err := md.ListMessages(tt.renamed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 {
+				t.Errorf("local folder %s contains %d messages, expected 1", tt.renamed, len(messages))
+			}
+
+			if got := serverFolders(t, h); strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Errorf("got server folders %v, expected %v", got, expected)
+			}
+		})
+	}
+}
+
+// hierarchyBackend is a memory backend where subfolders are renamed together with their parent,
+// and each folder has its own UID validity, like on most servers
+type hierarchyBackend struct {
+	*memory.Backend
+
+	mu          sync.Mutex
+	uidValidity map[string]uint32
+	next        uint32
+}
+
+func newHierarchyBackend() *hierarchyBackend {
+	return &hierarchyBackend{Backend: memory.New(), uidValidity: make(map[string]uint32)}
+}
+
+func (be *hierarchyBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &hierarchyUser{User: user, be: be}, nil
+}
+
+// folderUIDValidity returns the UID validity of a folder, which is assigned the first time it's used
+func (be *hierarchyBackend) folderUIDValidity(name string) uint32 {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+
+	if _, ok := be.uidValidity[name]; !ok {
+		be.next++
+		be.uidValidity[name] = be.next
+	}
+	return be.uidValidity[name]
+}
+
+type hierarchyUser struct {
+	backend.User
+	be *hierarchyBackend
+}
+
+func (u *hierarchyUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes, err := u.User.ListMailboxes(subscribed)
+	for i, mbox := range mailboxes {
+		mailboxes[i] = hierarchyMailbox{Mailbox: mbox, user: u}
+	}
+	return mailboxes, err
+}
+
+func (u *hierarchyUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return hierarchyMailbox{Mailbox: mbox, user: u}, nil
+}
+
+func (u *hierarchyUser) RenameMailbox(existingName, newName string) error {
+	mailboxes, err := u.User.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, mbox := range mailboxes {
+		if name := mbox.Name(); name == existingName || strings.HasPrefix(name, existingName+"/") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("no such mailbox")
+	}
+	for _, name := range names {
+		renamed := newName + strings.TrimPrefix(name, existingName)
+		uidValidity := u.be.folderUIDValidity(name)
+		err = u.User.RenameMailbox(name, renamed)
+		if err != nil {
+			return err
+		}
+
+		u.be.mu.Lock()
+		u.be.uidValidity[renamed] = uidValidity
+		delete(u.be.uidValidity, name)
+		u.be.mu.Unlock()
+	}
+	return nil
+}
+
+type hierarchyMailbox struct {
+	backend.Mailbox
+	user *hierarchyUser
+}
+
+func (mbox hierarchyMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := mbox.Mailbox.Status(items)
+	if err == nil {
+		status.UidValidity = mbox.user.be.folderUIDValidity(mbox.Name())
+	}
+	return status, err
+}
+
+// newFolderTest returns a handler connected to a server containing 'folders', besides INBOX,
+// and a maildir in which the folders have been synchronized.
+// Each folder contains a message, since the UID validity of empty folders isn't recorded
+func newFolderTest(t *testing.T, mailbox config.Mailbox, layout string, folders ...string) (*Handler, backend.User, *maildir.Maildir) {
+	t.Helper()
+
+	h, user := newTestBackendHandler(t, newHierarchyBackend(), mailbox)
+	for _, name := range folders {
+		err := user.CreateMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mbox, err := user.GetMailbox(name)
+		if err == nil {
+			err = mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString("Subject: "+name+"\r\n\r\nhello\r\n"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "imap-sync-folders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	md, err := maildir.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { md.Close() })
+
+	err = md.SetLayout(layout, "/")
+	if err == nil {
+		err = md.SetFolderMap(h.FolderMap())
+	}
+	if err == nil {
+		err = h.SyncFolders(context.Background(), md)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Folders are recorded with the UID validity they had when they were last synchronized
+	for _, name := range append(folders, "INBOX") {
+		err = h.CheckFolder(context.Background(), md, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = h.SyncFolders(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, user, md
+}
+
+// checkFolders checks that the folders on both sides are the expected ones
+func checkFolders(t *testing.T, h *Handler, md *maildir.Maildir, expected ...string) {
+	t.Helper()
+
+	expected = append([]string{"INBOX"}, expected...)
+	sort.Strings(expected)
+
+	folders, err := md.Folders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(folders)
+	if strings.Join(folders, ",") != strings.Join(expected, ",") {
+		t.Errorf("got local folders %v, expected %v", folders, expected)
+	}
+	if got := serverFolders(t, h); strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("got server folders %v, expected %v", got, expected)
+	}
+}
+
+// checkMessages checks that each of the local folders contain a single message
+func checkMessages(t *testing.T, md *maildir.Maildir, folders ...string) {
+	t.Helper()
+
+	for _, name := range folders {
+		messages, err := md.ListMessages(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 {
+			t.Errorf("local folder %s contains %d messages, expected 1", name, len(messages))
+		}
+	}
+}
+
+func TestSyncFoldersRenamesParent(t *testing.T) {
+	for _, layout := range []string{maildir.LayoutVerbatim, maildir.LayoutFS, maildir.LayoutMaildirPP} {
+		t.Run(layout+"/server", func(t *testing.T) {
+			h, user, md := newFolderTest(t, config.Mailbox{FolderDeletePolicy: config.DeletePolicyDelete}, layout, "A", "A/child")
+
+			err := user.RenameMailbox("A", "B")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = h.SyncFolders(context.Background(), md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFolders(t, h, md, "B", "B/child")
+			checkMessages(t, md, "B", "B/child")
+		})
+
+		t.Run(layout+"/local", func(t *testing.T) {
+			h, _, md := newFolderTest(t, config.Mailbox{FolderDeletePolicy: config.DeletePolicyDelete}, layout, "A", "A/child")
+
+			// Subfolders are only stored inside their parent in the hierarchical layouts
+			err := md.RenameFolder("A", "B")
+			if err == nil && layout == maildir.LayoutMaildirPP {
+				err = md.RenameFolder("A/child", "B/child")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = h.SyncFolders(context.Background(), md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFolders(t, h, md, "B", "B/child")
+			checkMessages(t, md, "B", "B/child")
+		})
+	}
+}
+
+func TestSyncFoldersFolderMapChanged(t *testing.T) {
+	h, _, md := newFolderTest(t, config.Mailbox{FolderDeletePolicy: config.DeletePolicyDelete}, maildir.LayoutVerbatim, "Archive")
+
+	// Archive is now stored in another local folder, so its old folder is no longer used.
+	// That must not be mistaken for the folder having been deleted locally
+	err := md.SetFolderMap(map[string]string{"Archive": "Old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.SyncFolders(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFolders(t, h, md, "Archive")
+
+	// The new folder map is recorded, so folders are synchronized as usual from now on
+	_, sameLayout, err := md.KnownFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameLayout {
+		t.Errorf("folder map was not recorded")
+	}
+}
+
+func TestSyncFoldersDeleteRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		deleted  []string // Folders deleted locally
+		maxRatio float64  // Configured max_delete_ratio
+		refused  bool
+	}{
+		{"single folder", []string{"A"}, 0, false},
+		{"most folders", []string{"A", "B", "C"}, 0, true},
+		{"maildir missing", []string{"INBOX", "A", "B", "C", "D"}, 0, true},
+		{"below configured ratio", []string{"A", "B", "C"}, 0.9, false},
+		{"above configured ratio", []string{"A"}, 0.1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailbox := config.Mailbox{FolderDeletePolicy: config.DeletePolicyDelete, MaxDeleteRatio: tt.maxRatio}
+			h, _, md := newFolderTest(t, mailbox, maildir.LayoutVerbatim, "A", "B", "C", "D")
+
+			for _, name := range tt.deleted {
+				err := md.RemoveFolder(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := h.SyncFolders(context.Background(), md)
+			if tt.refused {
+				if err == nil || !strings.Contains(err.Error(), "max_delete_ratio") {
+					t.Errorf("got error %v, expected the deletes to be refused", err)
+				}
+				if got := serverFolders(t, h); len(got) != 5 {
+					t.Errorf("got server folders %v, expected none of them to be deleted", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deleted := make(map[string]bool)
+			for _, name := range tt.deleted {
+				deleted[name] = true
+			}
+			var remaining []string
+			for _, name := range []string{"A", "B", "C", "D"} {
+				if !deleted[name] {
+					remaining = append(remaining, name)
+				}
+			}
+			checkFolders(t, h, md, remaining...)
+		})
+	}
+}
+
+func TestFolderMapUpload(t *testing.T) {
+	// Sent Items is stored locally as Sent, either because it's configured in folder_map,
+	// or because of its special-use attribute
+	tests := []struct {
+		name    string
+		mailbox config.Mailbox
+	}{
+		{"folder_map", config.Mailbox{FolderMap: map[string]string{"Sent Items": "Sent"}}},
+		{"special_use_names", config.Mailbox{SpecialUseNames: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newSpecialUseHandler(t, tt.mailbox, map[string]string{"Sent Items": SpecialUseSent})
+			createMessages(t, user, "Sent Items", "sent")
+
+			md := newTestMaildir(t)
+			err := md.SetFolderMap(h.FolderMap())
+			if err == nil {
+				err = h.SyncFolders(context.Background(), md)
+			}
+			if err == nil {
+				err = h.CheckMessages(context.Background(), md)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The server folder is stored under its local name
+			messages, err := md.ListMessages("Sent Items")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 {
+				t.Fatalf("folder Sent Items contains %d local messages, expected 1", len(messages))
+			}
+			folderDir := filepath.Dir(filepath.Dir(messages[0].Filename))
+			if filepath.Base(folderDir) != "Sent" {
+				t.Errorf("message was stored in %s, expected local folder Sent", folderDir)
+			}
+			root := filepath.Dir(folderDir)
+			if _, err = os.Stat(filepath.Join(root, "Sent Items")); !os.IsNotExist(err) {
+				t.Errorf("local folder Sent Items was created: %v", err)
+			}
+
+			// A message added to the local folder is uploaded to the server folder
+			body := "Message-ID: <upload@example.com>\r\nSubject: upload\r\n\r\nhello\r\n"
+			err = ioutil.WriteFile(filepath.Join(folderDir, "new", "1600000000.upload.localhost"), []byte(body), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ch := make(chan mail.Info, 10)
+			err = md.ScanFolder(context.Background(), "Sent Items", ch)
+			close(ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var uploads []mail.Info
+			for info := range ch {
+				uploads = append(uploads, info)
+			}
+			if len(uploads) != 1 || uploads[0].FolderName != "Sent Items" {
+				t.Fatalf("got new local messages %v, expected a single message in Sent Items", uploads)
+			}
+
+			f, err := os.Open(uploads[0].Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, err := h.AddMessage(&Upload{Info: uploads[0]}, &literal.FileLiteral{File: f})
+			if err == nil {
+				_, err = md.RenameMessage(info)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mbox, err := user.GetMailbox("Sent Items")
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Messages != 2 {
+				t.Errorf("server folder Sent Items contains %d messages, expected 2", status.Messages)
+			}
+			if folders := serverFolders(t, h); strings.Join(folders, ",") != "INBOX,Sent Items" {
+				t.Errorf("got server folders %v, expected INBOX and Sent Items", folders)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// capIdle is the capability advertised by servers supporting IDLE (RFC 2177)
+const capIdle = "IDLE"
+
+// idleRestartInterval is the maximum time we stay in IDLE before restarting it.
+// RFC 2177 recommends restarting at least every 29 minutes, to avoid being logged out
+const idleRestartInterval = 25 * time.Minute
+
+// idleCommand is an IDLE command, as defined in RFC 2177
+type idleCommand struct{}
+
+func (cmd *idleCommand) Command() *imap.Command {
+	return &imap.Command{Name: "IDLE"}
+}
+
+// idleResponse waits for the server to accept the IDLE command,
+// and then sends DONE when 'stop' is closed
+type idleResponse struct {
+	stop    <-chan struct{}
+	replies chan []byte
+}
+
+func (r *idleResponse) Replies() <-chan []byte {
+	return r.replies
+}
+
+func (r *idleResponse) Handle(resp imap.Resp) error {
+	if _, ok := resp.(*imap.ContinuationReq); !ok {
+		return responses.ErrUnhandled
+	}
+
+	go func() {
+		<-r.stop
+		r.replies <- []byte("DONE\r\n")
+	}()
+	return nil
+}
+
+// idle sends an IDLE command, and keeps the connection idle until 'stop' is closed
+func (h *Handler) idle(stop <-chan struct{}) error {
+	res := &idleResponse{stop: stop, replies: make(chan []byte, 1)}
+	status, err := h.client.Execute(&idleCommand{}, res)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// Watch waits for changes in a folder on the server, and sends the name of the folder
+// on 'changed' whenever something happens. IDLE is used if the server supports it,
+// otherwise the server is polled with NOOP every 'pollInterval'.
+// Watch blocks until the context is cancelled or an error occurs.
+// Note that the handler should not be used for anything else while watching,
+// and that it should be created with NewWatcher.
+func (h *Handler) Watch(ctx context.Context, folderName string, pollInterval time.Duration, changed chan<- string) error {
+	if pollInterval <= 0 {
+		pollInterval = maildir.DefaultPollInterval
+	}
+	folderName = decodeFolderName(folderName)
+
+	// Blocking the updates channel blocks the whole client, so we'll use a large buffer,
+	// and always drain it before notifying anyone
+	updates := make(chan client.Update, 100)
+	h.client.Updates = updates
+
+	_, err := h.client.Select(folderName, true)
+	if err != nil {
+		return err
+	}
+
+	hasIdle, err := h.client.Support(capIdle)
+	if err != nil {
+		return err
+	}
+
+	// Ignore the updates received while selecting the folder
+	for len(updates) > 0 {
+		<-updates
+	}
+
+	notify := func() {
+		for {
+			select {
+			case <-updates:
+				continue
+			default:
+			}
+			break
+		}
+
+		select {
+		case changed <- folderName:
+		default:
+			// A notification is already pending
+		}
+	}
+
+	for {
+		if !hasIdle {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pollInterval):
+			}
+
+			err = h.client.Noop()
+			if err != nil {
+				return err
+			}
+
+			if len(updates) > 0 {
+				notify()
+			}
+			continue
+		}
+
+		stop := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- h.idle(stop)
+		}()
+
+		var gotUpdate bool
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-done
+			return ctx.Err()
+		case <-updates:
+			gotUpdate = true
+			close(stop)
+			err = <-done
+		case <-time.After(idleRestartInterval):
+			close(stop)
+			err = <-done
+		case err = <-done:
+			// The server ended the IDLE command
+			close(stop)
+		}
+		if err != nil {
+			return err
+		}
+
+		if gotUpdate {
+			notify()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yzzyx/imap-sync/config"
+)
+
+// qresyncServer is a scripted IMAP server that supports IDLE and QRESYNC.
+// A message is expunged as soon as a client starts idling, which is reported with VANISHED
+// if the client has enabled QRESYNC, as required by RFC 7162, and with EXPUNGE otherwise
+func qresyncServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveQResync(conn)
+		}
+	}()
+	return l
+}
+
+func serveQResync(conn net.Conn) {
+	defer conn.Close()
+
+	const capabilities = "IMAP4rev1 IDLE ENABLE CONDSTORE QRESYNC"
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "* OK [CAPABILITY %s] ready\r\n", capabilities)
+
+	var qresync bool
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		tag, cmd := fields[0], strings.ToUpper(fields[1])
+
+		switch cmd {
+		case "CAPABILITY":
+			fmt.Fprintf(conn, "* CAPABILITY %s\r\n", capabilities)
+		case "ENABLE":
+			qresync = true
+			fmt.Fprintf(conn, "* ENABLED QRESYNC\r\n")
+		case "LIST":
+			if strings.Contains(line, `"*"`) {
+				fmt.Fprintf(conn, "* LIST () \"/\" INBOX\r\n")
+			} else {
+				fmt.Fprintf(conn, "* LIST (\\Noselect) \"/\" \"\"\r\n")
+			}
+		case "SELECT", "EXAMINE":
+			fmt.Fprintf(conn, "* 1 EXISTS\r\n* OK [UIDVALIDITY 1] UIDs valid\r\n* OK [UIDNEXT 2] Predicted next UID\r\n")
+		case "IDLE":
+			fmt.Fprintf(conn, "+ idling\r\n")
+			if qresync {
+				fmt.Fprintf(conn, "* VANISHED 1\r\n")
+			} else {
+				fmt.Fprintf(conn, "* 1 EXPUNGE\r\n")
+			}
+			if _, err = r.ReadString('\n'); err != nil {
+				return
+			}
+		case "LOGOUT":
+			fmt.Fprintf(conn, "* BYE\r\n%s OK LOGOUT completed\r\n", tag)
+			return
+		}
+		fmt.Fprintf(conn, "%s OK %s completed\r\n", tag, cmd)
+	}
+}
+
+func TestWatchExpungeWithQResync(t *testing.T) {
+	l := qresyncServer(t)
+
+	h, err := NewWatcher(config.Mailbox{
+		Server:            "127.0.0.1",
+		Port:              l.Addr().(*net.TCPAddr).Port,
+		Username:          "username",
+		Password:          "password",
+		AllowInsecureAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Watch(ctx, "INBOX", time.Minute, changed)
+	}()
+
+	select {
+	case folder := <-changed:
+		if folder != "INBOX" {
+			t.Errorf("got change in folder %s, expected INBOX", folder)
+		}
+	case err = <-done:
+		t.Fatalf("watch ended before the expunge was noticed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expunge on the server was not noticed")
+	}
+
+	cancel()
+	<-done
+}
@@ -9,8 +9,10 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"log"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	uidplus "github.com/emersion/go-imap-uidplus"
@@ -36,24 +38,51 @@ type Client struct {
 type Handler struct {
 	mailbox config.Mailbox
 	client  *Client
+
+	condstore bool // Server supports CONDSTORE (RFC 7162)
+	qresync   bool // QRESYNC (RFC 7162) has been enabled
+	watcher   bool // Only used to watch a folder for changes, see NewWatcher
+
+	pool     []*Handler // Additional connections used to synchronize folders in parallel
+	parallel bool       // Set while folders are synchronized in parallel
+
+	filter     *folderFilter     // Decides which folders are synchronized
+	specialUse map[string]string // Special-use attributes mapped to folder names
+	moves      *serverMoves      // Messages removed from a folder during the current sync
+
+	tlsConfig   *tls.Config
+	tokens      *tokenSource // Used for OAuth2 authentication
+	tokenExpiry time.Time    // Expiry of the access token used to log in
 }
 
 // New creates a new Handler for processing IMAP mailboxes
 func New(mailbox config.Mailbox) (*Handler, error) {
+	return newHandler(mailbox, false)
+}
+
+// NewWatcher creates a new Handler that is only used to watch a folder for changes with Watch.
+// QRESYNC is never enabled for it, since the server then reports expunged messages with
+// VANISHED responses instead of EXPUNGE, and those are not passed on as updates by the client
+func NewWatcher(mailbox config.Mailbox) (*Handler, error) {
+	return newHandler(mailbox, true)
+}
+
+func newHandler(mailbox config.Mailbox, watcher bool) (*Handler, error) {
 	var err error
-	h := Handler{}
+	h := Handler{watcher: watcher}
 
 	h.mailbox = mailbox
 
-	if h.mailbox.PasswordCmd != "" {
-		cmd := exec.Command("sh", "-c", h.mailbox.PasswordCmd)
-		out := &bytes.Buffer{}
-		cmd.Stdout = out
-		err = cmd.Run()
+	if h.mailbox.OAuth2 != nil {
+		h.tokens, err = newTokenSource(*h.mailbox.OAuth2, h.mailbox.Username)
+		if err != nil {
+			return nil, err
+		}
+	} else if h.mailbox.PasswordCmd != "" {
+		h.mailbox.Password, err = runCommand(h.mailbox.PasswordCmd)
 		if err != nil {
 			return nil, err
 		}
-		h.mailbox.Password = strings.TrimRight(out.String(), "\n\r")
 	}
 
 	if h.mailbox.Server == "" {
@@ -62,10 +91,38 @@ func New(mailbox config.Mailbox) (*Handler, error) {
 	if h.mailbox.Username == "" {
 		return nil, errors.New("imap username not configured")
 	}
-	if h.mailbox.Password == "" {
+	if h.mailbox.Password == "" && h.tokens == nil && !h.usesExternalAuth() {
 		return nil, errors.New("imap password not configured")
 	}
 
+	// Folder names in the configuration might have been copied from a tool that uses modified UTF-7
+	h.mailbox.IdleFolders = decodeFolderNames(h.mailbox.IdleFolders)
+	h.mailbox.Folders.Include = decodeFolderNames(h.mailbox.Folders.Include)
+	h.mailbox.Folders.Exclude = decodeFolderNames(h.mailbox.Folders.Exclude)
+	if h.mailbox.Folders.Rules != nil {
+		rules := make([]config.FolderRule, len(h.mailbox.Folders.Rules))
+		for i, r := range h.mailbox.Folders.Rules {
+			rules[i] = config.FolderRule{Include: decodeFolderName(r.Include), Exclude: decodeFolderName(r.Exclude)}
+		}
+		h.mailbox.Folders.Rules = rules
+	}
+	if h.mailbox.FolderMap != nil {
+		folderMap := make(map[string]string)
+		for serverName, localName := range h.mailbox.FolderMap {
+			folderMap[decodeFolderName(serverName)] = localName
+		}
+		h.mailbox.FolderMap = folderMap
+	}
+
+	if h.mailbox.MaxRetries == 0 {
+		h.mailbox.MaxRetries = config.DefaultMaxRetries
+	} else if h.mailbox.MaxRetries < 0 {
+		h.mailbox.MaxRetries = 0
+	}
+	if h.mailbox.RetryDelay <= 0 {
+		h.mailbox.RetryDelay = config.DefaultRetryDelay
+	}
+
 	// Set default port
 	if h.mailbox.Port == 0 {
 		h.mailbox.Port = 143
@@ -74,17 +131,44 @@ func New(mailbox config.Mailbox) (*Handler, error) {
 		}
 	}
 
+	h.tlsConfig, err = h.newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// The hierarchy delimiter is needed to compile wildcard patterns
+	delimiter, err := h.Delimiter()
+	if err == nil {
+		h.filter, err = newFolderFilter(h.mailbox.Folders, delimiter)
+	}
+	if err == nil {
+		err = h.detectSpecialUse()
+	}
+	if err != nil {
+		h.client.Logout()
+		return nil, err
+	}
+	return &h, nil
+}
+
+// connect opens a new connection to the server, and logs in
+func (h *Handler) connect() error {
+	var err error
 	connectionString := fmt.Sprintf("%s:%d", h.mailbox.Server, h.mailbox.Port)
-	tlsConfig := &tls.Config{ServerName: h.mailbox.Server}
 	var c *client.Client
 	if h.mailbox.UseTLS {
-		c, err = client.DialTLS(connectionString, tlsConfig)
+		c, err = client.DialTLS(connectionString, h.tlsConfig)
 	} else {
 		c, err = client.Dial(connectionString)
 	}
 
 	if err != nil {
-		return nil, err
+		return h.tlsError(err)
 	}
 
 	h.client = &Client{
@@ -94,116 +178,373 @@ func New(mailbox config.Mailbox) (*Handler, error) {
 
 	// Start a TLS session
 	if h.mailbox.UseStartTLS {
-		if err = h.client.StartTLS(tlsConfig); err != nil {
-			return nil, err
+		if err = h.client.StartTLS(h.tlsConfig); err != nil {
+			return h.tlsError(err)
 		}
 	}
 
-	err = h.client.Login(h.mailbox.Username, h.mailbox.Password)
+	err = h.authenticate()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &h, nil
+
+	if h.watcher {
+		return nil
+	}
+	return h.enableExtensions()
 }
 
-// Close closes all open handles, flushes channels and saves configuration data
-func (h *Handler) Close() error {
-	err := h.client.Close()
+// runCommand runs a helper command, and returns the first line of its output,
+// e.g. a password or a token
+func runCommand(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out.String(), "\n\r"), nil
+}
+
+// Refresh reconnects to the server if the credentials used to log in have expired,
+// which is the case when an OAuth2 access token has expired.
+// This is used in long-running modes, since some servers close the connection when that happens
+func (h *Handler) Refresh() error {
+	if h.tokens == nil || time.Now().Before(h.tokenExpiry) {
+		return nil
+	}
+
+	for _, c := range h.pool {
+		c.Close()
+	}
+	h.pool = nil
+	h.client.Logout()
+	return h.connect()
+}
+
+// enableExtensions checks which of the extensions used for incremental synchronization
+// the server supports, and enables QRESYNC if it's available
+func (h *Handler) enableExtensions() error {
+	var err error
+	h.condstore, err = h.client.Support(capCondStore)
 	if err != nil {
 		return err
 	}
 
-	err = h.client.Logout()
-	return err
+	hasQResync, err := h.client.Support(capQResync)
+	if err != nil {
+		return err
+	}
+	if !hasQResync {
+		return nil
+	}
+
+	status, err := h.client.Execute(&enableCommand{Capabilities: []string{capQResync}}, nil)
+	if err != nil {
+		return err
+	}
+
+	// QRESYNC implies CONDSTORE
+	h.qresync = status.Err() == nil
+	h.condstore = h.condstore || h.qresync
+	return nil
 }
 
-func (h *Handler) listFolders() ([]string, error) {
-	includeAll := false
-	// If no specific folders are listed to be included, assume all folders should be included
-	if len(h.mailbox.Folders.Include) == 0 {
-		includeAll = true
+// Close closes all open handles, flushes channels and saves configuration data
+// Note that we don't issue a CLOSE command, since that would implicitly expunge
+// all messages flagged as deleted in the selected mailbox
+func (h *Handler) Close() error {
+	for _, c := range h.pool {
+		c.Close()
 	}
+	h.pool = nil
+	return h.client.Logout()
+}
 
-	// Make a map of included and excluded mailboxes
-	includedFolders := make(map[string]bool)
-	for _, folder := range h.mailbox.Folders.Include {
-		// Note - we set this to false to keep track of if it exists on the server or not
-		includedFolders[folder] = false
+// connections returns up to 'count' connections to the server, including our own,
+// opening new connections as needed, up to the configured limit.
+// If the server refuses to open more connections, we'll make do with the ones we have
+func (h *Handler) connections(count int) []*Handler {
+	if count > h.mailbox.Connections {
+		count = h.mailbox.Connections
 	}
 
-	excludedFolders := make(map[string]bool)
-	for _, folder := range h.mailbox.Folders.Exclude {
-		excludedFolders[folder] = true
+	for len(h.pool)+1 < count {
+		c := &Handler{mailbox: h.mailbox, tlsConfig: h.tlsConfig, tokens: h.tokens, filter: h.filter, specialUse: h.specialUse}
+		err := c.connect()
+		if err != nil {
+			log.Printf("cannot open additional connection to %s: %v", h.mailbox.Server, err)
+			break
+		}
+		h.pool = append(h.pool, c)
 	}
 
+	conns := []*Handler{h}
+	for i := 0; i < len(h.pool) && len(conns) < count; i++ {
+		conns = append(conns, h.pool[i])
+	}
+	return conns
+}
+
+// Folders returns the names of all folders on the server that should be synchronized
+func (h *Handler) Folders() ([]string, error) {
+	return h.listFolders()
+}
+
+// Delimiter returns the hierarchy delimiter used by the server.
+// An empty string is returned if the server doesn't use a hierarchy
+func (h *Handler) Delimiter() (string, error) {
+	// LIST with an empty mailbox name returns the delimiter, as described in RFC 3501
 	mboxChan := make(chan *imap.MailboxInfo, 10)
 	errChan := make(chan error, 1)
 	go func() {
-		if err := h.client.List("", "*", mboxChan); err != nil {
-			errChan <- err
-		}
+		errChan <- h.client.List("", "", mboxChan)
 	}()
 
-	var folderNames []string
+	var delimiter string
 	for mb := range mboxChan {
-		if mb == nil {
-			// We're done
-			break
-		}
+		delimiter = mb.Delimiter
+	}
+	if err := <-errChan; err != nil {
+		return "", err
+	}
+	return delimiter, nil
+}
 
-		// Check if this mailbox should be excluded
-		if _, ok := excludedFolders[mb.Name]; ok {
+// FolderMap returns the local names used for server folders, as configured in folder_map
+func (h *Handler) FolderMap() map[string]string {
+	return h.mailbox.FolderMap
+}
+
+// FolderIncluded returns true if a folder should be synchronized
+func (h *Handler) FolderIncluded(name string) bool {
+	return h.filter.included(name)
+}
+
+func (h *Handler) listFolders() ([]string, error) {
+	mailboxes, err := h.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var folderNames []string
+	seen := make(map[string]bool)
+	localNames := make(map[string]string)
+	for _, mb := range mailboxes {
+		seen[mb.Name] = true
+		if !h.filter.included(mb.Name) {
 			continue
 		}
 
-		if !includeAll {
-			if _, ok := includedFolders[mb.Name]; !ok {
-				continue
-			}
-			includedFolders[mb.Name] = true
+		// Two server folders can't share a local folder, which can happen if a folder is
+		// mapped to a local name that another folder on the server already uses
+		localName := mb.Name
+		if name, ok := h.mailbox.FolderMap[mb.Name]; ok {
+			localName = name
 		}
+		if other, ok := localNames[localName]; ok {
+			return nil, fmt.Errorf("folders %s and %s would both be stored in local folder %s", other, mb.Name, localName)
+		}
+		localNames[localName] = mb.Name
 
 		folderNames = append(folderNames, mb.Name)
 	}
 
-	// Check if an error occurred while fetching data
-	select {
-	case err := <-errChan:
-		return nil, err
-	default:
-	}
-
-	// Check if any of the specified folders were missing on the server
-	for folder, seen := range includedFolders {
-		if !seen {
+	// Check if any of the folders included by name were missing on the server
+	for _, folder := range h.filter.names() {
+		if seen[folder] || !h.filter.included(folder) {
+			continue
+		}
+		if !h.mailbox.Folders.WarnMissing {
 			return nil, fmt.Errorf("folder %s not found on server", folder)
 		}
+		log.Printf("folder %s not found on server", folder)
 	}
 
 	return folderNames, nil
 }
 
 // CheckMessages checks for new/unindexed messages on the server
-// If 'fullScan' is set to true, we will iterate through all messages, and check for
-// any updated flags that doesn't match our current set
+// If more than one connection has been configured, folders are synchronized in parallel
 func (h *Handler) CheckMessages(ctx context.Context, md *maildir.Maildir) error {
 	var err error
 
-	mailboxes, err := h.listFolders()
+	var mailboxes []string
+	err = h.Retry(ctx, "listing folders", func() error {
+		mailboxes, err = h.listFolders()
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, mailboxName := range mailboxes {
-		err = md.CreateFolder(mailboxName)
+	err = h.SyncLocalMoves(ctx, md)
+	if err != nil {
+		return err
+	}
+	return h.checkFolders(ctx, md, mailboxes, "")
+}
+
+// SyncFolder synchronizes a single folder with the server, e.g. after it has changed.
+// If messages have been removed from the folder, the other folders are synchronized as well,
+// since they might have been moved there on the server. Messages moved to this folder from
+// another one are downloaded again, and removed from the other folder when it's synchronized.
+// Nothing is done if the folder isn't synchronized
+func (h *Handler) SyncFolder(ctx context.Context, md *maildir.Maildir, folderName string) error {
+	var err error
+
+	var mailboxes []string
+	err = h.Retry(ctx, "listing folders", func() error {
+		mailboxes, err = h.listFolders()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range mailboxes {
+		if name != folderName {
+			continue
+		}
+
+		// Messages moved out of the folder would otherwise be deleted on the server
+		err = h.SyncLocalMoves(ctx, md)
 		if err != nil {
 			return err
 		}
+		return h.checkFolders(ctx, md, mailboxes, folderName)
+	}
+	return nil
+}
+
+// checkFolders synchronizes the folders in 'mailboxes' with the server, detecting messages moved between them.
+// If 'first' is set, that folder is synchronized first, and the others only if messages have been removed from it
+func (h *Handler) checkFolders(ctx context.Context, md *maildir.Maildir, mailboxes []string, first string) error {
+	var err error
+
+	conns := h.connections(len(mailboxes))
+	moves := newServerMoves()
+	for _, c := range conns {
+		c.moves = moves
+	}
+	defer func() {
+		for _, c := range conns {
+			c.moves = nil
+		}
+	}()
 
-		err = h.mailboxFetchMessages(ctx, md, mailboxName)
+	if first != "" {
+		err = h.CheckFolder(ctx, md, first)
 		if err != nil {
 			return err
 		}
+		if moves.empty() {
+			return nil
+		}
+
+		// The removed messages might have been moved to any of the other folders
+		var others []string
+		for _, name := range mailboxes {
+			if name != first {
+				others = append(others, name)
+			}
+		}
+		mailboxes = others
 	}
-	return nil
+
+	// Messages removed on the server are collected from all folders before any new messages are downloaded,
+	// so that moves are detected regardless of the order in which the folders are synchronized
+	if len(mailboxes) > 1 {
+		err = h.eachFolder(ctx, conns, mailboxes, func(c *Handler, folderName string) error {
+			return c.Retry(ctx, "looking for removed messages in folder "+folderName, func() error {
+				return c.collectRemoved(ctx, md, folderName)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = h.eachFolder(ctx, conns, mailboxes, func(c *Handler, folderName string) error {
+		return c.CheckFolder(ctx, md, folderName)
+	})
+	if err != nil {
+		return err
+	}
+	return h.finishServerMoves(md)
+}
+
+// eachFolder calls 'fn' for each folder in a list, using the connections in 'conns' in parallel
+func (h *Handler) eachFolder(ctx context.Context, conns []*Handler, mailboxes []string, fn func(c *Handler, folderName string) error) error {
+	var err error
+	if len(conns) <= 1 {
+		for _, mailboxName := range mailboxes {
+			err = fn(h, mailboxName)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, c := range conns {
+		c.parallel = true
+	}
+	defer func() {
+		for _, c := range conns {
+			c.parallel = false
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	folders := make(chan string)
+	errs := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c *Handler) {
+			for folderName := range folders {
+				if err := fn(c, folderName); err != nil {
+					// Report the error before cancelling the others, so that it's the first one we receive
+					errs <- fmt.Errorf("folder %s: %w", folderName, err)
+					cancel()
+					return
+				}
+			}
+			errs <- nil
+		}(c)
+	}
+
+feed:
+	for _, mailboxName := range mailboxes {
+		select {
+		case folders <- mailboxName:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(folders)
+
+	for range conns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// CheckFolder synchronizes a single folder with the server
+func (h *Handler) CheckFolder(ctx context.Context, md *maildir.Maildir, folderName string) error {
+	err := md.CreateFolder(folderName)
+	if err != nil {
+		return err
+	}
+
+	return h.Retry(ctx, "synchronizing folder "+folderName, func() error {
+		return h.mailboxFetchMessages(ctx, md, folderName)
+	})
 }
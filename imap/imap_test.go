@@ -0,0 +1,123 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/yzzyx/imap-sync/config"
+)
+
+// newTestHandler starts an IMAP server that keeps its mailboxes in memory, and returns a handler connected to it,
+// along with the user on the server, which can be used to set up and inspect the mailboxes.
+// The server contains an INBOX with a single message
+func newTestHandler(t *testing.T, mailbox config.Mailbox) (*Handler, backend.User) {
+	t.Helper()
+	return newTestBackendHandler(t, memory.New(), mailbox)
+}
+
+// newTestBackendHandler starts an IMAP server using 'be', and returns a handler connected to it,
+// along with the user on the server
+func newTestBackendHandler(t *testing.T, be backend.Backend, mailbox config.Mailbox) (*Handler, backend.User) {
+	t.Helper()
+
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	if ext, ok := be.(server.Extension); ok {
+		// Backends that implement extensions, e.g. CONDSTORE, handle the commands themselves
+		s.Enable(ext)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	mailbox.Server = "127.0.0.1"
+	mailbox.Port = l.Addr().(*net.TCPAddr).Port
+	mailbox.Username = "username"
+	mailbox.Password = "password"
+	mailbox.AllowInsecureAuth = true
+	h, err := New(mailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h, user
+}
+
+func TestCheckMessagesParallel(t *testing.T) {
+	h, user := newTestHandler(t, config.Mailbox{Connections: 3})
+	folders := []string{"A", "B", "C", "D", "E"}
+	for i, name := range folders {
+		err := user.CreateMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each folder gets a different number of messages, so that they aren't mixed up
+		var subjects []string
+		for j := 0; j <= i; j++ {
+			subjects = append(subjects, fmt.Sprintf("%s%d", name, j))
+		}
+		createMessages(t, user, name, subjects...)
+	}
+
+	md := newTestMaildir(t)
+	err := h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.pool) != 2 {
+		t.Errorf("got %d additional connections, expected 2", len(h.pool))
+	}
+
+	for i, name := range folders {
+		messages, err := md.ListMessages(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != i+1 {
+			t.Errorf("folder %s contains %d local messages, expected %d", name, len(messages), i+1)
+		}
+		for _, info := range messages {
+			if info.FolderName != name {
+				t.Errorf("folder %s contains message from folder %s", name, info.FolderName)
+			}
+		}
+		state, err := md.State(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state.UIDs()) != i+1 {
+			t.Errorf("folder %s has %d synchronized messages, expected %d", name, len(state.UIDs()), i+1)
+		}
+	}
+
+	// A second sync over the same connections doesn't change anything
+	err = h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range folders {
+		messages, err := md.ListMessages(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != i+1 {
+			t.Errorf("folder %s contains %d local messages after syncing again, expected %d", name, len(messages), i+1)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/emersion/go-imap"
+	uidplus "github.com/emersion/go-imap-uidplus"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// capMove is the capability for the MOVE command (RFC 6851)
+const capMove = "MOVE"
+
+// moveCommand is a MOVE command, as defined in RFC 6851
+type moveCommand struct {
+	SeqSet  *imap.SeqSet
+	Mailbox string
+}
+
+func (cmd *moveCommand) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	return &imap.Command{
+		Name:      "MOVE",
+		Arguments: []interface{}{cmd.SeqSet, imap.FormatMailboxName(mailbox)},
+	}
+}
+
+// copyUID collects the COPYUID response code (RFC 4315), which MOVE sends in an untagged OK response
+type copyUID struct {
+	UIDValidity uint32
+	UID         uint32
+}
+
+func (c *copyUID) Handle(resp imap.Resp) error {
+	status, ok := resp.(*imap.StatusResp)
+	if !ok || status.Tag != "*" || status.Code != uidplus.CodeCopyUid {
+		return responses.ErrUnhandled
+	}
+	c.parse(status.Arguments)
+	return nil
+}
+
+// parse reads the UID validity and UID of the destination from the arguments of COPYUID.
+// Only one message is moved at a time, so the destination is a single UID
+func (c *copyUID) parse(args []interface{}) {
+	if len(args) < 3 {
+		return
+	}
+	c.UIDValidity, _ = imap.ParseNumber(args[0])
+	c.UID, _ = imap.ParseNumber(args[2])
+}
+
+// SyncLocalMoves moves messages on the server that have been moved to another folder locally.
+// This must be done before local deletions are propagated, since a moved message is missing from its old folder
+func (h *Handler) SyncLocalMoves(ctx context.Context, md *maildir.Maildir) error {
+	return h.Retry(ctx, "moving messages", func() error {
+		// Look for moves every time we retry, since some of them may already have been handled
+		moves, err := md.LocalMoves()
+		if err != nil {
+			return err
+		}
+
+		var selected string
+		for _, move := range moves {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+
+			state, err := md.State(move.From)
+			if err != nil {
+				return err
+			}
+
+			if move.From != selected {
+				mbox, err := h.client.Select(move.From, false)
+				if err != nil {
+					return err
+				}
+				if int(mbox.UidValidity) != state.UIDValidity() {
+					// The UID is no longer valid, so the message is uploaded to its new folder as a new message instead
+					log.Printf("UID validity of folder %s has changed, uploading messages moved from it as new messages", move.From)
+					_, err = md.DetachMessage(move.Message)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				selected = move.From
+			}
+
+			uidValidity, uid, err := h.moveMessage(move)
+			if err != nil {
+				return fmt.Errorf("cannot move message from %s to %s: %w", move.From, move.Message.FolderName, err)
+			}
+
+			_, err = md.RelabelMessage(move.Message, int(uidValidity), int(uid), maildir.RelabelOptions{
+				Record:    true,
+				OldFolder: move.From,
+				OldUID:    move.UID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// moveMessage moves a message from the selected folder to the folder it's been moved to locally,
+// and returns its new UID, which is 0 if the server doesn't tell us.
+// Any flags that have been changed locally are updated first, so that they're moved along with the message
+func (h *Handler) moveMessage(move maildir.LocalMove) (uidValidity uint32, uid uint32, err error) {
+	err = h.storeFlags(uint32(move.UID), move.Flags, move.Message.Flags)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uint32(move.UID))
+	dest := move.Message.FolderName
+
+	hasMove, err := h.client.Support(capMove)
+	if err != nil {
+		return 0, 0, err
+	}
+	if hasMove {
+		c := &copyUID{}
+		status, err := h.client.Execute(&commands.Uid{Cmd: &moveCommand{SeqSet: seqSet, Mailbox: dest}}, c)
+		if err == nil {
+			err = status.Err()
+		}
+		if err == nil && status.Code == uidplus.CodeCopyUid {
+			c.parse(status.Arguments)
+		}
+		return c.UIDValidity, c.UID, err
+	}
+
+	// Without MOVE, the message is copied, and the original is flagged as deleted and expunged
+	uidValidity, _, dstUIDs, err := h.client.UidPlusClient.UidCopy(seqSet, dest)
+	if err != nil {
+		return 0, 0, err
+	}
+	if dstUIDs != nil && len(dstUIDs.Set) == 1 {
+		uid = dstUIDs.Set[0].Start
+	}
+
+	err = h.deleteUIDs(seqSet, true)
+	return uidValidity, uid, err
+}
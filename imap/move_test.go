@@ -0,0 +1,77 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+func TestLocalMoveUIDValidityChanged(t *testing.T) {
+	h, user := newTestHandler(t, config.Mailbox{})
+	for _, name := range []string{"A", "B"} {
+		err := user.CreateMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	createMessages(t, user, "A", "moved")
+
+	md := newTestMaildir(t)
+	err := h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := md.ListMessages("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("folder A contains %d local messages, expected 1", len(messages))
+	}
+
+	// Record another UID validity for A, as if it had changed on the server
+	state, err := md.State("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, _ := state.Message(messages[0].UID)
+	err = state.Replace(state.UIDValidity()+100, messages[0].UID, map[int]maildir.MessageState{messages[0].UID: synced})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the message locally, from <root>/A/cur to <root>/B/cur
+	root := filepath.Dir(filepath.Dir(filepath.Dir(messages[0].Filename)))
+	err = os.Rename(messages[0].Filename, filepath.Join(root, "B", "cur", filepath.Base(messages[0].Filename)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.SyncLocalMoves(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The message can't be moved on the server, so it must be uploaded as a new message
+	ch := make(chan mail.Info, 10)
+	err = md.ScanFolder(context.Background(), "B", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var scanned []mail.Info
+	for info := range ch {
+		scanned = append(scanned, info)
+	}
+	if len(scanned) != 1 || scanned[0].UID != 0 || maildir.IsSynced(filepath.Base(scanned[0].Filename)) {
+		t.Errorf("got new messages %v in folder B, expected the moved message without a UID", scanned)
+	}
+}
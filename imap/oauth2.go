@@ -0,0 +1,321 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/yzzyx/imap-sync/config"
+)
+
+// SASL mechanisms used for OAuth2 authentication
+const (
+	mechXOAuth2     = "XOAUTH2"
+	mechOAuthBearer = "OAUTHBEARER"
+)
+
+// tokenExpiryMargin is subtracted from the lifetime of an access token,
+// so that we don't try to use a token that's about to expire
+const tokenExpiryMargin = time.Minute
+
+// oauth2Token is an access token, as stored in the token cache.
+// If the server has issued a new refresh token that couldn't be written back to the
+// refresh_token_file, it's stored here as well, along with a hash of the configured token it replaced
+type oauth2Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Replaces     string    `json:"replaces,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// valid returns true if the token can be used for at least another 'tokenExpiryMargin'
+func (t *oauth2Token) valid() bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(tokenExpiryMargin).Before(t.Expiry)
+}
+
+// tokenResponse is the response from the token endpoint, as defined in RFC 6749
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refreshMu serializes refreshes between token sources, since handlers that are used to watch folders
+// have token sources of their own, which share the token cache, and some providers invalidate
+// a refresh token once a new one has been issued
+var refreshMu sync.Mutex
+
+// tokenSource hands out access tokens, and refreshes them when they have expired.
+// Tokens are cached on disk, so that they can be reused between runs, and by the handlers watching folders
+type tokenSource struct {
+	cfg      config.OAuth2
+	username string
+
+	mu    sync.Mutex
+	token *oauth2Token
+}
+
+// newTokenSource creates a token source for the OAuth2 settings of a mailbox
+func newTokenSource(cfg config.OAuth2, username string) (*tokenSource, error) {
+	if cfg.TokenURL == "" {
+		return nil, errors.New("oauth2 token_url not configured")
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("oauth2 client_id not configured")
+	}
+	if cfg.RefreshToken == "" && cfg.RefreshTokenCmd == "" && cfg.RefreshTokenFile == "" {
+		return nil, errors.New("oauth2 refresh token not configured")
+	}
+
+	if cfg.ClientSecretCmd != "" {
+		secret, err := runCommand(cfg.ClientSecretCmd)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get oauth2 client secret: %w", err)
+		}
+		cfg.ClientSecret = secret
+	}
+
+	if cfg.TokenCache == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		cfg.TokenCache = filepath.Join(cacheDir, "imap-sync", tokenCacheName(cfg, username))
+	}
+
+	return &tokenSource{cfg: cfg, username: username}, nil
+}
+
+// Token returns a valid access token, refreshing it if necessary
+func (ts *tokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token.valid() {
+		return ts.token.AccessToken, nil
+	}
+
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	// Another token source might have refreshed the token since we loaded it, in which case the refresh token
+	// we know about might have been replaced. A missing or broken cache just means that we have to request a new token
+	if cached, err := ts.loadCache(); err == nil {
+		ts.token = cached
+	}
+
+	if !ts.token.valid() {
+		err := ts.refresh()
+		if err != nil {
+			return "", err
+		}
+	}
+	return ts.token.AccessToken, nil
+}
+
+// Expiry returns the time when the current access token expires
+func (ts *tokenSource) Expiry() time.Time {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token == nil {
+		return time.Time{}
+	}
+	return ts.token.Expiry
+}
+
+// tokenCacheName returns the name of the default token cache.
+// The same username might be used with several providers, so the name depends on the token endpoint and client as well
+func tokenCacheName(cfg config.OAuth2, username string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == os.PathSeparator || r == ':' {
+			return '_'
+		}
+		return r
+	}, username)
+	sum := sha256.Sum256([]byte(cfg.TokenURL + "\n" + cfg.ClientID + "\n" + username))
+	return name + "-" + hex.EncodeToString(sum[:8]) + ".token"
+}
+
+// tokenHash returns a hash of a refresh token, which is used to tell if the configured token has changed
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// configuredRefreshToken reads the refresh token from the configured source
+func (ts *tokenSource) configuredRefreshToken() (string, error) {
+	switch {
+	case ts.cfg.RefreshTokenFile != "":
+		data, err := ioutil.ReadFile(ts.cfg.RefreshTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case ts.cfg.RefreshTokenCmd != "":
+		return runCommand(ts.cfg.RefreshTokenCmd)
+	}
+	return ts.cfg.RefreshToken, nil
+}
+
+// refresh requests a new access token from the token endpoint.
+// A refresh token issued by the server takes precedence over the configured one, since some providers
+// invalidate the old token when issuing a new one, unless the configured token has changed since then
+func (ts *tokenSource) refresh() error {
+	configured, err := ts.configuredRefreshToken()
+	if err != nil {
+		return fmt.Errorf("cannot get oauth2 refresh token: %w", err)
+	}
+
+	refreshToken := configured
+	var replaces string
+	if ts.token != nil && ts.token.RefreshToken != "" && ts.token.Replaces == tokenHash(configured) {
+		refreshToken = ts.token.RefreshToken
+		replaces = ts.token.Replaces
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {ts.cfg.ClientID},
+	}
+	if ts.cfg.ClientSecret != "" {
+		form.Set("client_secret", ts.cfg.ClientSecret)
+	}
+	if len(ts.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.cfg.Scopes, " "))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(ts.cfg.TokenURL, form)
+	if err != nil {
+		return fmt.Errorf("cannot refresh oauth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	tr := tokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("cannot parse oauth2 token response: %w", err)
+	}
+	if tr.Error != "" {
+		return fmt.Errorf("cannot refresh oauth2 token: %s (%s)", tr.Error, tr.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot refresh oauth2 token: %s", resp.Status)
+	}
+	if tr.AccessToken == "" {
+		return errors.New("cannot refresh oauth2 token: no access token in response")
+	}
+
+	token := &oauth2Token{
+		AccessToken: tr.AccessToken,
+		Expiry:      time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+	}
+	if replaces != "" {
+		token.RefreshToken = refreshToken
+		token.Replaces = replaces
+	}
+	if tr.ExpiresIn == 0 {
+		// No lifetime was given, so we'll assume the common default of one hour
+		token.Expiry = time.Now().Add(time.Hour)
+	}
+
+	if tr.RefreshToken != "" && tr.RefreshToken != refreshToken {
+		if ts.cfg.RefreshTokenFile != "" {
+			err = ioutil.WriteFile(ts.cfg.RefreshTokenFile, []byte(tr.RefreshToken+"\n"), 0600)
+			if err != nil {
+				return fmt.Errorf("cannot save oauth2 refresh token: %w", err)
+			}
+			token.RefreshToken = ""
+			token.Replaces = ""
+		} else {
+			token.RefreshToken = tr.RefreshToken
+			token.Replaces = tokenHash(configured)
+		}
+	}
+
+	ts.token = token
+	return ts.saveCache()
+}
+
+// loadCache reads a previously stored token from the token cache
+func (ts *tokenSource) loadCache() (*oauth2Token, error) {
+	data, err := ioutil.ReadFile(ts.cfg.TokenCache)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2Token{}
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// saveCache writes the current token to the token cache
+func (ts *tokenSource) saveCache() error {
+	data, err := json.Marshal(ts.token)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(ts.cfg.TokenCache), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := ts.cfg.TokenCache + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, ts.cfg.TokenCache)
+}
+
+// oauth2Mechanisms returns the mechanisms used for OAuth2 authentication, in order of preference
+func (h *Handler) oauth2Mechanisms() []string {
+	if h.mailbox.OAuth2.Mechanism != "" {
+		return []string{h.mailbox.OAuth2.Mechanism}
+	}
+	return []string{mechOAuthBearer, mechXOAuth2}
+}
+
+// oauth2Client returns a SASL client that authenticates with an OAuth2 access token
+func (h *Handler) oauth2Client(mech string) (sasl.Client, error) {
+	if h.tokens == nil {
+		return nil, fmt.Errorf("%s requires oauth2 to be configured", mech)
+	}
+
+	token, err := h.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if mech == mechOAuthBearer {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: h.mailbox.Username,
+			Token:    token,
+			Host:     h.mailbox.Server,
+			Port:     h.mailbox.Port,
+		}), nil
+	}
+	return sasl.NewXoauth2Client(h.mailbox.Username, token), nil
+}
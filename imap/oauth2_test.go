@@ -0,0 +1,348 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yzzyx/imap-sync/config"
+)
+
+// tokenEndpoint is a stub OAuth2 token endpoint
+type tokenEndpoint struct {
+	mu       sync.Mutex
+	requests []string // Refresh tokens received
+	response map[string]interface{}
+	status   int
+}
+
+func (te *tokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+
+	if r.FormValue("grant_type") != "refresh_token" || r.FormValue("client_id") != "client" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+		return
+	}
+	te.requests = append(te.requests, r.FormValue("refresh_token"))
+
+	w.Header().Set("Content-Type", "application/json")
+	if te.status != 0 {
+		w.WriteHeader(te.status)
+	}
+	json.NewEncoder(w).Encode(te.response)
+}
+
+func (te *tokenEndpoint) refreshTokens() []string {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	return append([]string(nil), te.requests...)
+}
+
+// newTestTokenSource starts a stub token endpoint, and returns a token source using it.
+// The token cache and refresh token file are stored in 'dir'
+func newTestTokenSource(t *testing.T, dir string, te *tokenEndpoint) (*tokenSource, *httptest.Server) {
+	srv := httptest.NewServer(te)
+
+	ts, err := newTokenSource(config.OAuth2{
+		ClientID:         "client",
+		TokenURL:         srv.URL,
+		RefreshTokenFile: filepath.Join(dir, "refresh-token"),
+		TokenCache:       filepath.Join(dir, "cache", "token"),
+	}, "someone@example.com")
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return ts, srv
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "imap-sync-oauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path string, contents string) {
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "refresh-token"), "refresh-1\n")
+
+	te := &tokenEndpoint{response: map[string]interface{}{"access_token": "access-1", "expires_in": 3600}}
+	ts, srv := newTestTokenSource(t, dir, te)
+	defer srv.Close()
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" {
+		t.Errorf("got access token %q, expected %q", token, "access-1")
+	}
+	if got := te.refreshTokens(); len(got) != 1 || got[0] != "refresh-1" {
+		t.Errorf("got refresh requests %v, expected [refresh-1]", got)
+	}
+
+	// The token is still valid, so it should not be refreshed again
+	_, err = ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := te.refreshTokens(); len(got) != 1 {
+		t.Errorf("got %d refresh requests, expected 1", len(got))
+	}
+}
+
+func TestTokenRefreshError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response map[string]interface{}
+		expected string
+	}{
+		{"error response", http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant", "error_description": "Token has been revoked"}, "invalid_grant (Token has been revoked)"},
+		{"server error", http.StatusInternalServerError, map[string]interface{}{}, "500 Internal Server Error"},
+		{"no access token", http.StatusOK, map[string]interface{}{"expires_in": 3600}, "no access token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			writeFile(t, filepath.Join(dir, "refresh-token"), "refresh-1\n")
+
+			te := &tokenEndpoint{status: tt.status, response: tt.response}
+			ts, srv := newTestTokenSource(t, dir, te)
+			defer srv.Close()
+
+			_, err := ts.Token()
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("got error %v, expected it to contain %q", err, tt.expected)
+			}
+			if _, err = os.Stat(ts.cfg.TokenCache); !os.IsNotExist(err) {
+				t.Errorf("token cache was written after a failed refresh")
+			}
+		})
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	refreshTokenFile := filepath.Join(dir, "refresh-token")
+	writeFile(t, refreshTokenFile, "refresh-1\n")
+
+	te := &tokenEndpoint{response: map[string]interface{}{"access_token": "access-1", "refresh_token": "refresh-2", "expires_in": 3600}}
+	ts, srv := newTestTokenSource(t, dir, te)
+	defer srv.Close()
+
+	_, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(refreshTokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "refresh-2" {
+		t.Errorf("got refresh token %q in file, expected %q", got, "refresh-2")
+	}
+
+	// The new refresh token has been written back to the file, so it should not be cached
+	cached, err := ts.loadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.RefreshToken != "" {
+		t.Errorf("refresh token %q was stored in the token cache", cached.RefreshToken)
+	}
+
+	// The next refresh uses the new token
+	ts.token.Expiry = time.Now()
+	err = ts.saveCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := te.refreshTokens(); len(got) != 2 || got[1] != "refresh-2" {
+		t.Errorf("got refresh requests %v, expected [refresh-1 refresh-2]", got)
+	}
+}
+
+func TestTokenRotationWithoutFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	te := &tokenEndpoint{response: map[string]interface{}{"access_token": "access-1", "refresh_token": "refresh-2", "expires_in": 0}}
+	srv := httptest.NewServer(te)
+	defer srv.Close()
+
+	cfg := config.OAuth2{
+		ClientID:     "client",
+		TokenURL:     srv.URL,
+		RefreshToken: "refresh-1",
+		TokenCache:   filepath.Join(dir, "token"),
+	}
+	refresh := func(cfg config.OAuth2) {
+		t.Helper()
+		ts, err := newTokenSource(cfg, "someone@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.token, _ = ts.loadCache()
+		err = ts.refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The issued token can't be written back, so it's kept in the cache and used for the next refresh
+	refresh(cfg)
+	refresh(cfg)
+
+	// Once the configured token is changed, it takes precedence over the cached one
+	cfg.RefreshToken = "refresh-3"
+	refresh(cfg)
+
+	expected := []string{"refresh-1", "refresh-2", "refresh-3"}
+	if got := te.refreshTokens(); strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("got refresh requests %v, expected %v", got, expected)
+	}
+}
+
+func TestTokenCacheReuse(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "refresh-token"), "refresh-1\n")
+
+	te := &tokenEndpoint{response: map[string]interface{}{"access_token": "access-1", "expires_in": 3600}}
+	ts, srv := newTestTokenSource(t, dir, te)
+	defer srv.Close()
+
+	_, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new token source, e.g. in the next run, uses the cached token
+	ts, err = newTokenSource(ts.cfg, "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" {
+		t.Errorf("got access token %q, expected %q", token, "access-1")
+	}
+	if got := te.refreshTokens(); len(got) != 1 {
+		t.Errorf("got %d refresh requests, expected 1", len(got))
+	}
+}
+
+func TestTokenSharedCache(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	te := &tokenEndpoint{response: map[string]interface{}{"access_token": "access-1", "refresh_token": "refresh-2", "expires_in": 3600}}
+	srv := httptest.NewServer(te)
+	defer srv.Close()
+
+	// Two token sources for the same account, as used by the handler that synchronizes the account,
+	// and the one watching a folder for changes
+	cfg := config.OAuth2{
+		ClientID:     "client",
+		TokenURL:     srv.URL,
+		RefreshToken: "refresh-1",
+		TokenCache:   filepath.Join(dir, "token"),
+	}
+	var sources []*tokenSource
+	for i := 0; i < 2; i++ {
+		ts, err := newTokenSource(cfg, "someone@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, ts)
+	}
+
+	// Both tokens expire, and the first token source refreshes its token, which replaces the refresh token
+	te.mu.Lock()
+	te.response = map[string]interface{}{"access_token": "access-2", "refresh_token": "refresh-3", "expires_in": 3600}
+	te.mu.Unlock()
+	for _, ts := range sources {
+		ts.token.Expiry = time.Now()
+	}
+	err := sources[0].saveCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The other token source must use the refreshed token, instead of the refresh token that has been replaced
+	for i, ts := range sources {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "access-2" {
+			t.Errorf("got access token %q from token source %d, expected %q", token, i, "access-2")
+		}
+	}
+	expected := []string{"refresh-1", "refresh-2"}
+	if got := te.refreshTokens(); strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("got refresh requests %v, expected %v", got, expected)
+	}
+}
+
+func TestTokenCacheName(t *testing.T) {
+	base := config.OAuth2{TokenURL: "https://oauth2.example.com/token", ClientID: "client"}
+	otherURL := base
+	otherURL.TokenURL = "https://login.example.net/token"
+	otherClient := base
+	otherClient.ClientID = "other"
+
+	name := tokenCacheName(base, "someone@example.com")
+	if !strings.HasPrefix(name, "someone@example.com-") || !strings.HasSuffix(name, ".token") {
+		t.Errorf("unexpected token cache name %q", name)
+	}
+	if strings.ContainsRune(tokenCacheName(base, "a/b"), '/') {
+		t.Errorf("token cache name contains a path separator")
+	}
+
+	for _, cfg := range []config.OAuth2{otherURL, otherClient} {
+		if other := tokenCacheName(cfg, "someone@example.com"); other == name {
+			t.Errorf("token cache for %s/%s has the same name as for %s/%s", cfg.TokenURL, cfg.ClientID, base.TokenURL, base.ClientID)
+		}
+	}
+	if tokenCacheName(base, "other@example.com") == name {
+		t.Errorf("token cache for another user has the same name")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// maxRetryDelay is the longest we wait between two attempts to reconnect
+const maxRetryDelay = 5 * time.Minute
+
+// disconnected returns true if 'err' was caused by the connection to the server being lost
+func (h *Handler) disconnected(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	select {
+	case <-h.client.LoggedOut():
+		return true
+	default:
+	}
+	if h.client.State() == imap.LogoutState {
+		return true
+	}
+
+	// Note that *os.PathError also implements net.Error, so we can't check for that
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &opErr)
+}
+
+// reconnect opens a new connection to the server, replacing the one that was lost.
+// Failed attempts are retried with an exponentially increasing delay
+func (h *Handler) reconnect(ctx context.Context) error {
+	// The old connection is most likely dead already, but make sure it's closed
+	h.client.Logout()
+
+	delay := time.Duration(h.mailbox.RetryDelay) * time.Second
+
+	var err error
+	for attempt := 0; attempt <= h.mailbox.MaxRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("cannot reconnect to %s, retrying in %s: %v", h.mailbox.Server, delay, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+
+		err = h.connect()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Retry runs 'fn', and if it fails because the connection was lost, reconnects and runs it again.
+// 'fn' must be safe to run again after a partial failure. This holds for folder synchronization,
+// since progress is recorded in the maildir state as soon as each message has been written,
+// and for uploads, since an Upload checks if the message was stored before sending it again.
+// Gives up after the configured number of retries
+func (h *Handler) Retry(ctx context.Context, op string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || !h.disconnected(err) || attempt >= h.mailbox.MaxRetries {
+			return err
+		}
+
+		log.Printf("connection to %s lost while %s, reconnecting: %v", h.mailbox.Server, op, err)
+		err = h.reconnect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
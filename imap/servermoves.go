@@ -0,0 +1,286 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// serverMoves keeps track of messages that have disappeared from a folder on the server during a sync.
+// If the same message shows up as a new message in another folder, it has been moved on the server,
+// and the local copy is moved as well, instead of downloading the message again.
+// Messages that don't show up anywhere are handled as deleted once all folders have been synchronized.
+// Until then, the mod-sequence of the folders they were removed from isn't saved, since the server
+// wouldn't report them as removed again if the sync is interrupted before they have been handled.
+type serverMoves struct {
+	mu        sync.Mutex
+	removed   map[messageKey][]mail.Info
+	modSeqs   map[string]uint64           // Mod-sequences to save for folders with removed messages, by folder
+	collected map[string]*collectedFolder // Server messages fetched by collectRemoved, by folder
+}
+
+// collectedFolder is the state of a folder on the server, as fetched when looking for removed messages.
+// It's used when the folder is synchronized, so that the messages don't have to be fetched twice
+type collectedFolder struct {
+	uidValidity uint32
+	changed     *changes
+	server      *serverMessages
+}
+
+func newServerMoves() *serverMoves {
+	return &serverMoves{
+		removed:   make(map[messageKey][]mail.Info),
+		modSeqs:   make(map[string]uint64),
+		collected: make(map[string]*collectedFolder),
+	}
+}
+
+// add records a local message that no longer exists on the server.
+// Returns false if the message can't be identified, in which case it should be handled as deleted right away
+func (s *serverMoves) add(info mail.Info) bool {
+	header, err := mail.ReadFileHeader(info.Filename)
+	if err != nil {
+		return false
+	}
+	st, err := os.Stat(info.Filename)
+	if err != nil {
+		return false
+	}
+
+	key := messageKey{MessageID: mail.MessageID(header), Size: uint32(st.Size())}
+	if key.MessageID == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The folder might be synchronized again after a reconnect
+	for _, other := range s.removed[key] {
+		if other.Filename == info.Filename {
+			return true
+		}
+	}
+	s.removed[key] = append(s.removed[key], info)
+	return true
+}
+
+// take returns a removed message matching 'key', if there is one
+func (s *serverMoves) take(key messageKey) (mail.Info, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := s.removed[key]
+	if len(infos) == 0 {
+		return mail.Info{}, false
+	}
+	if len(infos) == 1 {
+		delete(s.removed, key)
+	} else {
+		s.removed[key] = infos[1:]
+	}
+	return infos[0], true
+}
+
+// empty returns true if there are no removed messages left
+func (s *serverMoves) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.removed) == 0
+}
+
+// setCollected records the server messages fetched from a folder by collectRemoved
+func (s *serverMoves) setCollected(folderName string, c *collectedFolder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collected[folderName] = c
+}
+
+// takeCollected returns the server messages fetched from a folder by collectRemoved, if any.
+// They are only used once, so that they are fetched again if the sync is retried
+func (s *serverMoves) takeCollected(folderName string) (*collectedFolder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.collected[folderName]
+	delete(s.collected, folderName)
+	return c, ok
+}
+
+// deferModSeq records the mod-sequence of a folder, if messages removed from it haven't been handled yet.
+// Returns false if there are no such messages, in which case the mod-sequence can be saved right away
+func (s *serverMoves) deferModSeq(folderName string, modSeq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, list := range s.removed {
+		for _, info := range list {
+			if info.FolderName == folderName {
+				s.modSeqs[folderName] = modSeq
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remaining returns all removed messages that haven't shown up in another folder,
+// together with the mod-sequences that were deferred until they have been handled
+func (s *serverMoves) remaining() ([]mail.Info, map[string]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var infos []mail.Info
+	for _, list := range s.removed {
+		infos = append(infos, list...)
+	}
+	modSeqs := s.modSeqs
+	s.removed = make(map[messageKey][]mail.Info)
+	s.modSeqs = make(map[string]uint64)
+	s.collected = make(map[string]*collectedFolder)
+	return infos, modSeqs
+}
+
+// deferServerDelete returns true if the handling of a message that has been removed on the server
+// should wait until all folders have been synchronized, since it might have been moved to another folder
+func (h *Handler) deferServerDelete(info mail.Info) bool {
+	if h.moves == nil {
+		return false
+	}
+	return h.moves.add(info)
+}
+
+// collectRemoved records the messages that have been removed from a folder on the server, without handling them.
+// This is done for all folders before any of them are synchronized, since the messages might show up
+// as new messages in a folder that is synchronized before the folder they were removed from
+func (h *Handler) collectRemoved(ctx context.Context, md *maildir.Maildir, folderName string) error {
+	state, err := md.State(folderName)
+	if err != nil {
+		return err
+	}
+	uids := state.UIDs()
+	if state.UIDValidity() == 0 || len(uids) == 0 {
+		return nil
+	}
+
+	var mbox *imap.MailboxStatus
+	var changed *changes
+	if h.condstore {
+		mbox, changed, err = h.selectChanged(folderName, uint32(state.UIDValidity()), state.HighestModSeq())
+	} else {
+		mbox, err = h.client.Select(folderName, false)
+	}
+	if err != nil {
+		return err
+	}
+	if int(mbox.UidValidity) != state.UIDValidity() {
+		// The messages are matched by their contents when we recover from the UID validity change instead
+		return nil
+	}
+
+	server, err := h.fetchServerMessages(mbox, changed, state, uint32(uids[len(uids)-1]))
+	if err != nil {
+		return err
+	}
+	h.moves.setCollected(folderName, &collectedFolder{uidValidity: mbox.UidValidity, changed: changed, server: server})
+
+	messages, err := md.SyncedMessages(folderName)
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range uids {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if info, ok := messages[uid]; ok && !server.exists(uid) {
+			h.moves.add(info)
+		}
+	}
+	return nil
+}
+
+// collectedMessages returns the server messages fetched from a folder by collectRemoved, if any
+func (h *Handler) collectedMessages(folderName string) (*collectedFolder, bool) {
+	if h.moves == nil {
+		return nil, false
+	}
+	return h.moves.takeCollected(folderName)
+}
+
+// relocateMoved moves the local copies of messages that have been moved to this folder on the server,
+// and returns the new messages that still have to be downloaded
+func (h *Handler) relocateMoved(md *maildir.Maildir, folderName string, uidValidity uint32, newMessages []remoteMessage) ([]remoteMessage, error) {
+	if h.moves == nil || h.moves.empty() || len(newMessages) == 0 {
+		return newMessages, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	for _, rm := range newMessages {
+		seqSet.AddNum(rm.UID)
+	}
+	remote, err := h.fetchMessageIDs(seqSet)
+	if err != nil {
+		return nil, err
+	}
+
+	relocated := make(map[uint32]bool)
+	for _, rm := range remote {
+		if rm.MessageID == "" {
+			continue
+		}
+		info, ok := h.moves.take(messageKey{rm.MessageID, rm.Size})
+		if !ok {
+			continue
+		}
+
+		_, err = md.RelabelMessage(info, int(uidValidity), int(rm.UID), maildir.RelabelOptions{
+			Folder:     folderName,
+			Record:     true,
+			MergeFlags: true,
+			OldFolder:  info.FolderName,
+			OldUID:     info.UID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		relocated[rm.UID] = true
+	}
+
+	var remaining []remoteMessage
+	for _, rm := range newMessages {
+		if !relocated[rm.UID] {
+			remaining = append(remaining, rm)
+		}
+	}
+	return remaining, nil
+}
+
+// finishServerMoves handles the messages that were removed on the server, but didn't show up in another folder,
+// and then saves the mod-sequences of the folders they were removed from
+func (h *Handler) finishServerMoves(md *maildir.Maildir) error {
+	infos, modSeqs := h.moves.remaining()
+	for _, info := range infos {
+		err := h.handleServerDelete(md, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	for folderName, modSeq := range modSeqs {
+		state, err := md.State(folderName)
+		if err == nil {
+			err = state.SetHighestModSeq(modSeq)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
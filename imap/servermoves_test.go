@@ -0,0 +1,381 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+func TestServerMoves(t *testing.T) {
+	policies := []string{config.DeletePolicyDelete, config.DeletePolicyTrash, config.DeletePolicyKeep}
+
+	for _, policy := range policies {
+		// The message is moved in both directions, so that it's moved to a folder that is synchronized
+		// before its old folder in at least one of them
+		for _, dir := range [][2]string{{"A", "B"}, {"B", "A"}} {
+			from, to := dir[0], dir[1]
+			t.Run(policy+"/"+from+"-"+to, func(t *testing.T) {
+				h, user := newTestHandler(t, config.Mailbox{ServerDeletePolicy: policy})
+				for _, name := range []string{"A", "B"} {
+					err := user.CreateMailbox(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				src, err := user.GetMailbox(from)
+				if err == nil {
+					body := "Message-ID: <moved@example.com>\r\nSubject: moved\r\n\r\nhello\r\n"
+					err = src.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString(body))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				tmpDir, err := ioutil.TempDir("", "imap-sync-moves")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(tmpDir)
+
+				md, err := maildir.New(tmpDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer md.Close()
+
+				err = h.CheckMessages(context.Background(), md)
+				if err != nil {
+					t.Fatal(err)
+				}
+				messages, err := md.ListMessages(from)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(messages) != 1 {
+					t.Fatalf("folder %s contains %d local messages, expected 1", from, len(messages))
+				}
+				before, err := os.Stat(messages[0].Filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Move the message on the server
+				seqSet := new(imap.SeqSet)
+				seqSet.AddNum(1)
+				err = src.CopyMessages(true, seqSet, to)
+				if err == nil {
+					err = src.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.DeletedFlag})
+				}
+				if err == nil {
+					err = src.Expunge()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = h.CheckMessages(context.Background(), md)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				messages, err = md.ListMessages(from)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(messages) != 0 {
+					t.Errorf("folder %s contains %d local messages, expected none", from, len(messages))
+				}
+
+				messages, err = md.ListMessages(to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(messages) != 1 {
+					t.Fatalf("folder %s contains %d local messages, expected 1", to, len(messages))
+				}
+				after, err := os.Stat(messages[0].Filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !os.SameFile(before, after) {
+					t.Errorf("message was downloaded again, expected the local copy to be moved")
+				}
+
+				folders, err := md.Folders()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range folders {
+					if name == config.DefaultTrashFolder {
+						t.Errorf("trash folder was created, expected the message not to be handled as deleted")
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestServerMovesLaterFolderFails(t *testing.T) {
+	be := newCondstoreBackend(true)
+	h, user := newTestBackendHandler(t, be, config.Mailbox{})
+	for _, name := range []string{"A", "B"} {
+		err := user.CreateMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another message is kept, since all messages are compared when the folder is empty
+	createMessages(t, user, "A", "kept", "removed")
+
+	md := newTestMaildir(t)
+	err := h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the message on the server, and make the sync fail after folder A has been synchronized
+	mbox, err := user.GetMailbox("A")
+	if err == nil {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(2)
+		err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.DeletedFlag})
+	}
+	if err == nil {
+		err = mbox.Expunge()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	be.setFailing("B")
+	err = h.CheckMessages(context.Background(), md)
+	if err == nil {
+		t.Fatal("sync succeeded, expected folder B to fail")
+	}
+
+	// The removal must still be reported at the next sync, even though the server only reports changes
+	// made since the mod-sequence we've recorded
+	be.setFailing("")
+	err = h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := md.ListMessages("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].UID != 1 {
+		t.Errorf("folder A contains local messages %v, expected only UID 1", messages)
+	}
+	state, err := md.State("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids := state.UIDs(); len(uids) != 1 || uids[0] != 1 {
+		t.Errorf("folder state contains UIDs %v, expected only UID 1", uids)
+	}
+}
+
+func TestSyncFolderServerMove(t *testing.T) {
+	// The message is moved from A to B, and either folder is the one reported as changed.
+	// Other folders are only synchronized if messages have been removed from the changed folder,
+	// so if B is reported, the message is downloaded again, and A is left alone
+	tests := []struct {
+		changed string
+		moved   bool // Set if the local copy is moved
+		localA  int  // Number of messages left in A locally
+	}{
+		{"A", true, 0},
+		{"B", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.changed, func(t *testing.T) {
+			h, user := newTestHandler(t, config.Mailbox{})
+			for _, name := range []string{"A", "B"} {
+				err := user.CreateMailbox(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			createMessages(t, user, "A", "moved")
+
+			md := newTestMaildir(t)
+			err := h.CheckMessages(context.Background(), md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages, err := md.ListMessages("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 {
+				t.Fatalf("folder A contains %d local messages, expected 1", len(messages))
+			}
+			before, err := os.Stat(messages[0].Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src, err := user.GetMailbox("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			seqSet := new(imap.SeqSet)
+			seqSet.AddNum(1)
+			err = src.CopyMessages(true, seqSet, "B")
+			if err == nil {
+				err = src.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.DeletedFlag})
+			}
+			if err == nil {
+				err = src.Expunge()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = h.SyncFolder(context.Background(), md, tt.changed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err = md.ListMessages("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != tt.localA {
+				t.Errorf("folder A contains %d local messages, expected %d", len(messages), tt.localA)
+			}
+			messages, err = md.ListMessages("B")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 {
+				t.Fatalf("folder B contains %d local messages, expected 1", len(messages))
+			}
+			after, err := os.Stat(messages[0].Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.SameFile(before, after) != tt.moved {
+				t.Errorf("local copy moved: %v, expected %v", os.SameFile(before, after), tt.moved)
+			}
+		})
+	}
+}
+
+func TestSyncFolderOnly(t *testing.T) {
+	be := newCondstoreBackend(false)
+	h, user := newTestBackendHandler(t, be, config.Mailbox{})
+	for _, name := range []string{"A", "B"} {
+		err := user.CreateMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		createMessages(t, user, name, "message"+name)
+	}
+
+	md := newTestMaildir(t)
+	err := h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has been removed from A, so B must not be selected
+	be.setFailing("B")
+	createMessages(t, user, "A", "new")
+	err = h.SyncFolder(context.Background(), md, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := md.ListMessages("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("folder A contains %d local messages, expected 2", len(messages))
+	}
+
+	// Once a message is removed from A, B is synchronized as well
+	mbox, err := user.GetMailbox("A")
+	if err == nil {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(1)
+		err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.DeletedFlag})
+	}
+	if err == nil {
+		err = mbox.Expunge()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.SyncFolder(context.Background(), md, "A")
+	if err == nil {
+		t.Error("folder B was not synchronized after a message was removed from A")
+	}
+}
+
+func TestServerMovesFetchOnce(t *testing.T) {
+	be := newCondstoreBackend(false)
+	h, user := newTestBackendHandler(t, be, config.Mailbox{})
+	for _, name := range []string{"A", "B"} {
+		err := user.CreateMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		createMessages(t, user, name, "message"+name)
+	}
+
+	md := newTestMaildir(t)
+	err := h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(1)
+	for _, name := range []string{"A", "B"} {
+		mbox, err := user.GetMailbox(name)
+		if err == nil {
+			err = mbox.UpdateMessagesFlags(true, seqSet, imap.AddFlags, []string{imap.FlaggedFlag})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	be.mu.Lock()
+	be.fetched = 0
+	be.mu.Unlock()
+
+	err = h.CheckMessages(context.Background(), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The changes fetched while looking for removed messages are used when the folders are synchronized
+	be.mu.Lock()
+	fetched := be.fetched
+	be.mu.Unlock()
+	if fetched != 2 {
+		t.Errorf("server returned %d changed messages, expected each of the 2 changes to be fetched once", fetched)
+	}
+	for _, name := range []string{"A", "B"} {
+		messages, err := md.ListMessages(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || !mail.FlagsEqual(messages[0].Flags, []string{mail.FlagFlagged, mail.FlagSeen}) {
+			t.Errorf("folder %s contains %v, expected a single message with flags FS", name, messages)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"log"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Special-use attributes, as defined in RFC 6154
+const (
+	SpecialUseAll     = "\\All"
+	SpecialUseArchive = "\\Archive"
+	SpecialUseDrafts  = "\\Drafts"
+	SpecialUseFlagged = "\\Flagged"
+	SpecialUseJunk    = "\\Junk"
+	SpecialUseSent    = "\\Sent"
+	SpecialUseTrash   = "\\Trash"
+)
+
+// Capabilities used to find special-use folders
+const (
+	capSpecialUse = "SPECIAL-USE"
+	capXList      = "XLIST"
+)
+
+// xlistAttributes maps the attributes used by XLIST, which was used by Gmail before RFC 6154,
+// to the corresponding special-use attributes
+var xlistAttributes = map[string]string{
+	"\\AllMail": SpecialUseAll,
+	"\\Spam":    SpecialUseJunk,
+	"\\Starred": SpecialUseFlagged,
+}
+
+// xlistInbox is the attribute used by XLIST to mark the INBOX, which might have a localized name
+const xlistInbox = "\\Inbox"
+
+// specialUseNames are the local names used for special-use folders, if special_use_names is set
+var specialUseNames = map[string]string{
+	SpecialUseAll:     "All",
+	SpecialUseArchive: "Archive",
+	SpecialUseDrafts:  "Drafts",
+	SpecialUseFlagged: "Flagged",
+	SpecialUseJunk:    "Junk",
+	SpecialUseSent:    "Sent",
+	SpecialUseTrash:   "Trash",
+}
+
+// xlistCommand is an XLIST command, which works like LIST, but also returns special-use attributes
+type xlistCommand struct{}
+
+func (cmd *xlistCommand) Command() *imap.Command {
+	return &imap.Command{Name: capXList, Arguments: []interface{}{"", "*"}}
+}
+
+// xlistResponses collects the responses to an XLIST command
+type xlistResponses struct {
+	Mailboxes []*imap.MailboxInfo
+}
+
+func (r *xlistResponses) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != capXList {
+		return responses.ErrUnhandled
+	}
+
+	mbox := &imap.MailboxInfo{}
+	if err := mbox.Parse(fields); err != nil {
+		return err
+	}
+	r.Mailboxes = append(r.Mailboxes, mbox)
+	return nil
+}
+
+// list returns all folders on the server. If the server doesn't support SPECIAL-USE,
+// but supports XLIST, XLIST is used instead, and its attributes are translated
+func (h *Handler) list() ([]*imap.MailboxInfo, error) {
+	specialUse, err := h.client.Support(capSpecialUse)
+	if err != nil {
+		return nil, err
+	}
+	xlist, err := h.client.Support(capXList)
+	if err != nil {
+		return nil, err
+	}
+
+	if specialUse || !xlist {
+		mboxChan := make(chan *imap.MailboxInfo, 10)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- h.client.List("", "*", mboxChan)
+		}()
+
+		var mailboxes []*imap.MailboxInfo
+		for mb := range mboxChan {
+			mailboxes = append(mailboxes, mb)
+		}
+		return mailboxes, <-errChan
+	}
+
+	r := &xlistResponses{}
+	status, err := h.client.Execute(&xlistCommand{}, r)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mb := range r.Mailboxes {
+		for i, attr := range mb.Attributes {
+			if attr == xlistInbox {
+				mb.Name = imap.InboxName
+			} else if a, ok := xlistAttributes[attr]; ok {
+				mb.Attributes[i] = a
+			}
+		}
+	}
+	return r.Mailboxes, nil
+}
+
+// detectSpecialUse finds the special-use folders on the server.
+// If special_use_names is set, the folders are mapped to the same local names on all servers,
+// unless they're already listed in folder_map
+func (h *Handler) detectSpecialUse() error {
+	mailboxes, err := h.list()
+	if err != nil {
+		return err
+	}
+
+	h.specialUse = make(map[string]string)
+	serverNames := make(map[string]bool)
+	for _, mb := range mailboxes {
+		serverNames[mb.Name] = true
+		for _, attr := range mb.Attributes {
+			if _, ok := specialUseNames[attr]; ok {
+				if _, seen := h.specialUse[attr]; !seen {
+					h.specialUse[attr] = mb.Name
+				}
+			}
+		}
+	}
+
+	if !h.mailbox.SpecialUseNames {
+		return nil
+	}
+
+	folderMap := make(map[string]string)
+	localNames := make(map[string]bool)
+	for serverName, localName := range h.mailbox.FolderMap {
+		folderMap[serverName] = localName
+		localNames[localName] = true
+	}
+
+	for attr, serverName := range h.specialUse {
+		localName := specialUseNames[attr]
+		if _, ok := folderMap[serverName]; ok || serverName == localName {
+			continue
+		}
+		if serverNames[localName] || localNames[localName] {
+			log.Printf("%s folder %s is not stored as %s, since that name is already used", attr, serverName, localName)
+			continue
+		}
+		folderMap[serverName] = localName
+		localNames[localName] = true
+	}
+	h.mailbox.FolderMap = folderMap
+	return nil
+}
+
+// SpecialFolder returns the name of the folder on the server with a special-use attribute,
+// e.g. SpecialUseTrash. false is returned if the server doesn't have such a folder
+func (h *Handler) SpecialFolder(attr string) (string, bool) {
+	name, ok := h.specialUse[attr]
+	return name, ok
+}
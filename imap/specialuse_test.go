@@ -0,0 +1,155 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/yzzyx/imap-sync/config"
+)
+
+// specialUseBackend is a memory backend that supports SPECIAL-USE,
+// and lists folders with the special-use attributes in 'attributes'
+type specialUseBackend struct {
+	*memory.Backend
+	attributes map[string]string // Special-use attribute, by folder name
+}
+
+func (be *specialUseBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &specialUseUser{User: user, be: be}, nil
+}
+
+func (be *specialUseBackend) Capabilities(c server.Conn) []string {
+	return []string{capSpecialUse}
+}
+
+func (be *specialUseBackend) Command(name string) server.HandlerFactory {
+	return nil
+}
+
+type specialUseUser struct {
+	backend.User
+	be *specialUseBackend
+}
+
+func (u *specialUseUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes, err := u.User.ListMailboxes(subscribed)
+	for i, mbox := range mailboxes {
+		mailboxes[i] = specialUseMailbox{Mailbox: mbox, be: u.be}
+	}
+	return mailboxes, err
+}
+
+func (u *specialUseUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return specialUseMailbox{Mailbox: mbox, be: u.be}, nil
+}
+
+type specialUseMailbox struct {
+	backend.Mailbox
+	be *specialUseBackend
+}
+
+func (mbox specialUseMailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := mbox.Mailbox.Info()
+	if attr, ok := mbox.be.attributes[mbox.Name()]; ok && err == nil {
+		info.Attributes = append(info.Attributes, attr)
+	}
+	return info, err
+}
+
+// newSpecialUseHandler returns a handler connected to a server containing a folder for each of 'attributes',
+// along with 'folders', which don't have any special use
+func newSpecialUseHandler(t *testing.T, mailbox config.Mailbox, attributes map[string]string, folders ...string) (*Handler, backend.User) {
+	t.Helper()
+
+	// The special-use folders are detected when we connect, so they have to be created first
+	be := &specialUseBackend{Backend: memory.New(), attributes: attributes}
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range attributes {
+		folders = append(folders, name)
+	}
+	for _, name := range folders {
+		err = user.CreateMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newTestBackendHandler(t, be, mailbox)
+}
+
+func TestDetectSpecialUse(t *testing.T) {
+	attributes := map[string]string{
+		"Sent Items":    SpecialUseSent,
+		"Deleted Items": SpecialUseTrash,
+		"Junk":          SpecialUseJunk,
+		"Old":           SpecialUseArchive,
+		"Drafts2":       SpecialUseDrafts,
+	}
+
+	tests := []struct {
+		name            string
+		specialUseNames bool
+		folderMap       map[string]string
+		expected        map[string]string
+	}{
+		{"disabled", false, nil, nil},
+		{"disabled with folder_map", false, map[string]string{"Old": "Older"}, map[string]string{"Old": "Older"}},
+		// Junk already has its local name, Archive is used by another folder on the server,
+		// and Drafts2 is configured in folder_map
+		{"enabled", true, map[string]string{"Drafts2": "MyDrafts"}, map[string]string{
+			"Sent Items":    "Sent",
+			"Deleted Items": "Trash",
+			"Drafts2":       "MyDrafts",
+		}},
+		// A folder in folder_map already uses the local name Trash
+		{"local name in folder_map", true, map[string]string{"Other": "Trash"}, map[string]string{
+			"Sent Items": "Sent",
+			"Other":      "Trash",
+			"Drafts2":    "Drafts",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newSpecialUseHandler(t, config.Mailbox{SpecialUseNames: tt.specialUseNames, FolderMap: tt.folderMap},
+				attributes, "Archive", "Other")
+
+			for name, attr := range attributes {
+				folder, ok := h.SpecialFolder(attr)
+				if !ok || folder != name {
+					t.Errorf("got %s folder %q (%v), expected %q", attr, folder, ok, name)
+				}
+			}
+			if folder, ok := h.SpecialFolder(SpecialUseFlagged); ok {
+				t.Errorf("got %s folder %q, expected none", SpecialUseFlagged, folder)
+			}
+
+			folderMap := h.FolderMap()
+			if len(folderMap) != len(tt.expected) {
+				t.Errorf("got folder map %v, expected %v", folderMap, tt.expected)
+			}
+			for serverName, localName := range tt.expected {
+				if folderMap[serverName] != localName {
+					t.Errorf("got folder map %v, expected %v", folderMap, tt.expected)
+					break
+				}
+			}
+		})
+	}
+}
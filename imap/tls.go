@@ -0,0 +1,122 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// tlsVersions maps the versions accepted in the configuration to their TLS constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig creates the TLS configuration used for connections to the server
+func (h *Handler) newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: h.mailbox.Server}
+
+	if h.mailbox.TLSCAFile != "" {
+		data, err := ioutil.ReadFile(h.mailbox.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read tls_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in tls_ca_file %s", h.mailbox.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if h.mailbox.TLSCertFile != "" || h.mailbox.TLSKeyFile != "" {
+		keyFile := h.mailbox.TLSKeyFile
+		if keyFile == "" {
+			// The key might be stored in the same file as the certificate
+			keyFile = h.mailbox.TLSCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(h.mailbox.TLSCertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if h.mailbox.TLSMinVersion != "" {
+		version, ok := tlsVersions[h.mailbox.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls_min_version %s", h.mailbox.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if h.mailbox.TLSFingerprint != "" {
+		pin, err := parseFingerprint(h.mailbox.TLSFingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// A pinned certificate replaces the normal verification,
+		// so that self-signed certificates can be used
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server didn't present a certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("certificate fingerprint mismatch for %s: server presented %s, expected %s",
+					h.mailbox.Server, formatFingerprint(sum[:]), formatFingerprint(pin))
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// parseFingerprint parses a SHA-256 fingerprint, written as hex with optional colons
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("tls_fingerprint must be a SHA-256 fingerprint in hex, got %s", fingerprint)
+	}
+	return b, nil
+}
+
+// formatFingerprint formats a fingerprint as colon separated hex, which is how most tools display it
+func formatFingerprint(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// tlsError explains why the server certificate couldn't be verified, if that's the reason for the error
+func (h *Handler) tlsError(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("certificate for %s is signed by an unknown authority (configure tls_ca_file or tls_fingerprint): %w",
+			h.mailbox.Server, err)
+	case errors.As(err, &hostname):
+		return fmt.Errorf("certificate is not valid for %s: %w", h.mailbox.Server, err)
+	case errors.As(err, &invalid):
+		return fmt.Errorf("certificate for %s is invalid: %w", h.mailbox.Server, err)
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/yzzyx/imap-sync/config"
+)
+
+// newSelfSignedCert returns a self-signed certificate for 127.0.0.1
+func newSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "imap-sync test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	cert := newSelfSignedCert(t)
+	sum := sha256.Sum256(cert.Certificate[0])
+	other := sha256.Sum256([]byte("some other certificate"))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(memory.New())
+	go s.Serve(l)
+	defer s.Close()
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		err         string
+	}{
+		{"correct pin", formatFingerprint(sum[:]), ""},
+		{"correct pin without colons", strings.ToLower(strings.Replace(formatFingerprint(sum[:]), ":", "", -1)), ""},
+		{"wrong pin", formatFingerprint(other[:]), "certificate fingerprint mismatch"},
+		{"no pin", "", "unknown authority"},
+		{"invalid pin", "AB:CD", "must be a SHA-256 fingerprint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := New(config.Mailbox{
+				Server:         "127.0.0.1",
+				Port:           l.Addr().(*net.TCPAddr).Port,
+				Username:       "username",
+				Password:       "password",
+				UseTLS:         true,
+				TLSFingerprint: tt.fingerprint,
+			})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("cannot connect with pinned certificate: %v", err)
+				}
+				h.Close()
+				return
+			}
+			if err == nil {
+				h.Close()
+				t.Fatalf("connected to server, expected error containing %q", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
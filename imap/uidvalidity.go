@@ -0,0 +1,217 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// remoteMessage contains the information used to identify a message on the server
+type remoteMessage struct {
+	UID       uint32
+	MessageID string
+	Size      uint32
+}
+
+// messageKey identifies a message by its Message-ID and size
+type messageKey struct {
+	MessageID string
+	Size      uint32
+}
+
+// fetchMessageIDs returns the Message-ID and size of the messages in 'seqSet' in the selected mailbox
+func (h *Handler) fetchMessageIDs(seqSet *imap.SeqSet) ([]remoteMessage, error) {
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    []string{"Message-ID"},
+		},
+		Peek: true,
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, section.FetchItem()}
+
+	messages := make(chan *imap.Message, 100)
+	errchan := make(chan error, 1)
+	go func() {
+		if err := h.client.UidFetch(seqSet, items, messages); err != nil {
+			errchan <- err
+		}
+	}()
+
+	var remote []remoteMessage
+	for msg := range messages {
+		if msg == nil {
+			// We're done
+			break
+		}
+		if msg.Uid == 0 {
+			continue
+		}
+
+		rm := remoteMessage{UID: msg.Uid, Size: msg.Size}
+		if r := msg.GetBody(section); r != nil {
+			if header, err := mail.ReadHeader(r); err == nil {
+				rm.MessageID = mail.MessageID(header)
+			}
+		}
+		remote = append(remote, rm)
+	}
+
+	// Check if an error occurred while fetching data
+	select {
+	case err := <-errchan:
+		return nil, err
+	default:
+	}
+	return remote, nil
+}
+
+// recoverUIDValidity is used when the UID validity of a folder has changed on the server,
+// which means that all UIDs we know about are invalid.
+// Instead of downloading the whole folder again, we match local messages to messages on the server
+// by their Message-ID and size, and update their UIDs. If a Message-ID is unique on both sides,
+// the size is not required to match (e.g. if line endings were converted when the message was stored).
+// Local messages that can't be found on the server are uploaded again.
+//
+// The returned UID is the highest UID below which all messages on the server are available locally,
+// and is used as the starting point for downloading new messages.
+func (h *Handler) recoverUIDValidity(ctx context.Context, md *maildir.Maildir, folderName string, mbox *imap.MailboxStatus) (uint32, error) {
+	log.Printf("UID validity for folder %s has changed - matching local messages against server", folderName)
+
+	var err error
+	var remote []remoteMessage
+	uidValidity := mbox.UidValidity
+	if mbox.Messages > 0 {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddRange(1, 0)
+		remote, err = h.fetchMessageIDs(seqSet)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	byKey := make(map[messageKey][]uint32)
+	byID := make(map[string][]uint32)
+	for _, rm := range remote {
+		if rm.MessageID == "" {
+			continue
+		}
+		key := messageKey{rm.MessageID, rm.Size}
+		byKey[key] = append(byKey[key], rm.UID)
+		byID[rm.MessageID] = append(byID[rm.MessageID], rm.UID)
+	}
+
+	messages, err := md.ListMessages(folderName)
+	if err != nil {
+		return 0, err
+	}
+
+	type localMessage struct {
+		info mail.Info
+		key  messageKey
+	}
+	var local []localMessage
+	localIDs := make(map[string]int)
+	for _, info := range messages {
+		// Messages that haven't been uploaded yet are not affected
+		if info.UID == 0 {
+			continue
+		}
+
+		lm := localMessage{info: info}
+		if header, err := mail.ReadFileHeader(info.Filename); err == nil {
+			lm.key.MessageID = mail.MessageID(header)
+		}
+		if st, err := os.Stat(info.Filename); err == nil {
+			lm.key.Size = uint32(st.Size())
+		}
+		localIDs[lm.key.MessageID]++
+		local = append(local, lm)
+	}
+
+	// Find a match for each local message before changing anything
+	matched := make(map[uint32]bool)
+	relabel := make(map[uint32]mail.Info)
+	var unmatched []mail.Info
+	for _, lm := range local {
+		var uid uint32
+		candidates := byKey[lm.key]
+		if len(candidates) == 0 && localIDs[lm.key.MessageID] == 1 && len(byID[lm.key.MessageID]) == 1 {
+			candidates = byID[lm.key.MessageID]
+		}
+		for _, c := range candidates {
+			if !matched[c] {
+				uid = c
+				break
+			}
+		}
+
+		if lm.key.MessageID == "" || uid == 0 {
+			unmatched = append(unmatched, lm.info)
+			continue
+		}
+		matched[uid] = true
+		relabel[uid] = lm.info
+	}
+
+	state, err := md.State(folderName)
+	if err != nil {
+		return 0, err
+	}
+
+	// The files are renamed before the state is replaced, so if we're interrupted, the state still
+	// has the old UID validity, and we'll start over at the next sync. Files that have already been
+	// renamed are matched again, since they're matched by their contents and not by their UID.
+
+	// The messages might have been lost when the folder was migrated, so we keep them,
+	// and upload them again
+	for _, info := range unmatched {
+		if err = ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		_, err = md.DetachMessage(info)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The flags are not recorded as synchronized, so they will be merged with the flags on the server at the next sync
+	synced := make(map[int]maildir.MessageState)
+	for uid, info := range relabel {
+		if err = ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		info, err = md.RelabelMessage(info, int(uidValidity), int(uid), maildir.RelabelOptions{})
+		if err != nil {
+			return 0, err
+		}
+		synced[int(uid)] = maildir.MessageState{Filename: info.Filename}
+	}
+
+	// Find the highest UID where every message up to and including it is available locally
+	lastSeenUID := uint32(0)
+	for _, rm := range remote {
+		if !matched[rm.UID] {
+			break
+		}
+		lastSeenUID = rm.UID
+	}
+
+	err = state.Replace(int(uidValidity), int(lastSeenUID), synced)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("folder %s: %d messages matched, %d local messages not found on server to upload, %d messages to download",
+		folderName, len(matched), len(unmatched), len(remote)-len(matched))
+	return lastSeenUID, nil
+}
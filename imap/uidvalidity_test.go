@@ -0,0 +1,156 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// cancelAfter is a context that is cancelled after Err has been called 'n' times
+type cancelAfter struct {
+	context.Context
+	n int32
+}
+
+func (ctx *cancelAfter) Err() error {
+	if atomic.AddInt32(&ctx.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// serverFlags returns the flags of all messages in a folder on the server, indexed by UID
+func serverFlags(t *testing.T, h *Handler, folderName string) map[uint32]string {
+	t.Helper()
+
+	_, err := h.client.Select(folderName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := h.fetchFlags(1<<32 - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make(map[uint32]string)
+	for uid, f := range flags {
+		sort.Strings(f)
+		m[uint32(uid)] = strings.Join(f, "")
+	}
+	return m
+}
+
+func TestRecoverUIDValidityInterrupted(t *testing.T) {
+	h, user := newTestHandler(t, config.Mailbox{})
+
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		body := fmt.Sprintf("Message-ID: <%d@example.com>\r\nSubject: message %d\r\n\r\nhello\r\n", i, i)
+		err = mbox.CreateMessage([]string{imap.SeenFlag}, time.Now(), bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "imap-sync-uidvalidity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	md, err := maildir.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer md.Close()
+
+	err = h.CheckFolder(context.Background(), md, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := serverFlags(t, h, "INBOX")
+
+	// Give the local messages other UIDs, as if the UID validity of the folder had changed on the server
+	state, err := md.State("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := md.ListMessages("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := make(map[int]maildir.MessageState)
+	for _, info := range messages {
+		uid := info.UID + 100
+		newPath := strings.Replace(info.Filename, fmt.Sprintf(",U=%d:", info.UID), fmt.Sprintf(",U=%d:", uid), 1)
+		err = os.Rename(info.Filename, newPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old[uid] = maildir.MessageState{Filename: newPath, Flags: info.Flags}
+	}
+	err = state.Replace(7, 200, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the recovery after two messages have been renamed
+	status, err := h.client.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.recoverUIDValidity(&cancelAfter{Context: context.Background(), n: 2}, md, "INBOX", status)
+	if err != context.Canceled {
+		t.Fatalf("got error %v, expected recovery to be interrupted", err)
+	}
+	if state.UIDValidity() == int(status.UidValidity) {
+		t.Fatalf("UID validity was updated by an interrupted recovery")
+	}
+
+	// The next sync should finish the recovery, without downloading anything again
+	err = h.CheckFolder(context.Background(), md, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err = md.ListMessages("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != len(flags) {
+		t.Errorf("folder contains %d local messages, expected %d", len(messages), len(flags))
+	}
+	for _, info := range messages {
+		if _, ok := flags[uint32(info.UID)]; !ok {
+			t.Errorf("local message %s has UID %d, which doesn't exist on the server", filepath.Base(info.Filename), info.UID)
+		}
+		if _, ok := state.Message(info.UID); !ok {
+			t.Errorf("local message %s is not part of the state", filepath.Base(info.Filename))
+		}
+	}
+	if state.UIDValidity() != int(status.UidValidity) {
+		t.Errorf("got UID validity %d, expected %d", state.UIDValidity(), status.UidValidity)
+	}
+
+	if got := serverFlags(t, h, "INBOX"); fmt.Sprint(got) != fmt.Sprint(flags) {
+		t.Errorf("got flags %v on server, expected %v", got, flags)
+	}
+}
@@ -5,28 +5,72 @@ package imap
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/yzzyx/imap-sync/mail"
 )
 
-// AddMessage uploads a message to the IMAP server, and places it in the specific folder
-func (h *Handler) AddMessage(info mail.Info, reader imap.Literal) (mail.Info, error) {
+// Upload keeps track of a message that is being uploaded.
+// APPEND is not idempotent, so if the connection is lost while a message is being uploaded,
+// we have to check if the server stored it before sending it again
+type Upload struct {
+	Info mail.Info
+
+	sent    bool   // Set once the message has been sent to the server
+	uidNext uint32 // UIDNEXT of the folder before the message was sent, if the server doesn't support UIDPLUS
+}
+
+// AddMessage uploads a message to the IMAP server, and places it in the specific folder.
+// If an earlier attempt to upload the message was interrupted, and the server stored it anyway,
+// the stored message is used instead of uploading it again
+func (h *Handler) AddMessage(up *Upload, reader imap.Literal) (mail.Info, error) {
+	info := up.Info
 	hasUIDPlus, err := h.client.SupportUidPlus()
 	if err != nil {
 		return info, err
 	}
 
-	if !hasUIDPlus {
-		return info, errors.New("server does not support UIDPLUS, which is currently required for pushing new messages to server")
+	var messageID string
+	if header, err := mail.ReadFileHeader(info.Filename); err == nil {
+		messageID = mail.MessageID(header)
+	}
+
+	var uidValidity, uid uint32
+	if up.sent {
+		if messageID == "" {
+			return info, fmt.Errorf("connection was lost while uploading a message without Message-ID to %s, not uploading it again since it might have been stored already", info.FolderName)
+		}
+		uidValidity, uid, err = h.findMessage(info.FolderName, messageID, up.uidNext)
+		if err != nil {
+			return info, err
+		}
 	}
 
-	// FIXME - time should preferably be read from message
 	flags := mail.FlagsToIMAP(info.Flags)
-	uidValidity, uid, err := h.client.UidPlusClient.Append(info.FolderName, flags, time.Now(), reader)
-	if err != nil {
-		return info, err
+	if uid == 0 {
+		// Without UIDPLUS, we need UIDNEXT to find the message after it has been uploaded.
+		// With UIDPLUS, the server returns the UID, so if the connection is lost,
+		// any message in the folder with the same Message-ID is used instead
+		if !hasUIDPlus && up.uidNext == 0 {
+			up.uidNext, err = h.uidNext(info.FolderName)
+			if err != nil {
+				return info, err
+			}
+		}
+		up.sent = true
+
+		date := messageDate(info.Filename)
+		if hasUIDPlus {
+			uidValidity, uid, err = h.client.UidPlusClient.Append(info.FolderName, flags, date, reader)
+		} else {
+			uidValidity, uid, err = h.appendMessage(info.FolderName, messageID, up.uidNext, flags, date, reader)
+		}
+		if err != nil {
+			return info, err
+		}
 	}
 
 	// Servers are not forced to return UID, but we need them
@@ -41,3 +85,92 @@ func (h *Handler) AddMessage(info mail.Info, reader imap.Literal) (mail.Info, er
 	info.Flags = mail.FlagsFromIMAP(flags)
 	return info, err
 }
+
+// messageDate returns the date used as INTERNALDATE when a message is uploaded.
+// The date is read from the message headers, and if that fails, the modification time of the file is used
+func messageDate(filename string) time.Time {
+	if header, err := mail.ReadFileHeader(filename); err == nil {
+		if date, err := mail.Date(header); err == nil {
+			return date
+		}
+	}
+	if st, err := os.Stat(filename); err == nil {
+		return st.ModTime()
+	}
+	return time.Now()
+}
+
+// uidNext returns the UIDNEXT of a folder.
+// STATUS shouldn't be used on the selected folder, so it's selected again instead
+func (h *Handler) uidNext(folderName string) (uint32, error) {
+	if mbox := h.client.Mailbox(); mbox != nil && mbox.Name == folderName {
+		mbox, err := h.client.Select(folderName, false)
+		if err != nil {
+			return 0, err
+		}
+		return mbox.UidNext, nil
+	}
+
+	status, err := h.client.Status(folderName, []imap.StatusItem{imap.StatusUidNext})
+	if err != nil {
+		return 0, err
+	}
+	return status.UidNext, nil
+}
+
+// RequiresMessageID returns true if messages must have a Message-ID header to be uploaded,
+// which is the case if the server doesn't support UIDPLUS
+func (h *Handler) RequiresMessageID() (bool, error) {
+	hasUIDPlus, err := h.client.SupportUidPlus()
+	return !hasUIDPlus, err
+}
+
+// appendMessage uploads a message to a server that doesn't support UIDPLUS, and returns its UID.
+// Since the server doesn't tell us the UID, we search for the message by its Message-ID,
+// among the messages added to the folder after the upload started
+func (h *Handler) appendMessage(folderName string, messageID string, uidNext uint32, flags []string, date time.Time, reader imap.Literal) (uidValidity uint32, uid uint32, err error) {
+	if messageID == "" {
+		return 0, 0, errors.New("message has no Message-ID, which is required by servers that don't support UIDPLUS")
+	}
+
+	err = h.client.Client.Append(folderName, flags, date, reader)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	uidValidity, uid, err = h.findMessage(folderName, messageID, uidNext)
+	if err == nil && uid == 0 {
+		err = fmt.Errorf("cannot find uploaded message <%s> in folder %s", messageID, folderName)
+	}
+	return uidValidity, uid, err
+}
+
+// findMessage searches for a message with the given Message-ID, among the messages added to the folder
+// since UIDNEXT was 'uidNext'. If 'uidNext' is 0, all messages are searched.
+// Returns a UID of 0 if no such message exists
+func (h *Handler) findMessage(folderName string, messageID string, uidNext uint32) (uidValidity uint32, uid uint32, err error) {
+	mbox, err := h.client.Select(folderName, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uidNext == 0 {
+		uidNext = 1
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(uidNext, 0)
+	criteria.Header.Add("Message-ID", messageID)
+	uids, err := h.client.UidSearch(criteria)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// If the message was added more than once, e.g. by another client, we use the latest one
+	for _, u := range uids {
+		if u >= uidNext && u > uid {
+			uid = u
+		}
+	}
+	return mbox.UidValidity, uid, nil
+}
@@ -0,0 +1,289 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/literal"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// writeMessage writes a message with the given headers to a temporary file
+func writeMessage(t *testing.T, headers string) (mail.Info, []byte) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "imap-sync-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	body := []byte(headers + "From: someone@example.com\r\nSubject: upload\r\n\r\nhello\r\n")
+	path := filepath.Join(dir, "message")
+	err = ioutil.WriteFile(path, body, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mail.Info{FolderName: "INBOX", Filename: path, Flags: []string{mail.FlagSeen}}, body
+}
+
+func TestAddMessageRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  string
+		stored   bool // Set if the server stored the message before the connection was lost
+		uidNext  bool // Set if UIDNEXT was recorded before the message was sent, which isn't done with UIDPLUS
+		expected int  // Number of messages in the folder afterwards
+		err      string
+	}{
+		{"stored", "Message-ID: <retry@example.com>\r\n", true, true, 2, ""},
+		{"not stored", "Message-ID: <retry@example.com>\r\n", false, true, 2, ""},
+		{"stored without UIDNEXT", "Message-ID: <retry@example.com>\r\n", true, false, 2, ""},
+		{"not stored without UIDNEXT", "Message-ID: <retry@example.com>\r\n", false, false, 2, ""},
+		{"no Message-ID", "", true, true, 2, "without Message-ID"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newTestHandler(t, config.Mailbox{})
+			info, body := writeMessage(t, tt.headers)
+
+			mbox, err := user.GetMailbox("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, err := mbox.Status([]imap.StatusItem{imap.StatusUidNext})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The connection was lost during an earlier attempt to upload the message
+			up := &Upload{Info: info, sent: true}
+			if tt.uidNext {
+				up.uidNext = status.UidNext
+			}
+			if tt.stored {
+				err = mbox.CreateMessage(nil, time.Now(), bytes.NewBuffer(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			info, err = h.AddMessage(up, bytes.NewBuffer(body))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if info.UID != int(status.UidNext) {
+				t.Errorf("got UID %d, expected %d", info.UID, status.UidNext)
+			}
+
+			status, err = mbox.Status([]imap.StatusItem{imap.StatusMessages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(status.Messages) != tt.expected {
+				t.Errorf("folder contains %d messages, expected %d", status.Messages, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAddMessageWithoutUIDPlus(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		ensure  bool // Set if a Message-ID is added before uploading, as done when syncing
+		err     string
+	}{
+		{"Message-ID", "Message-ID: <fallback@example.com>\r\n", false, ""},
+		{"synthesized Message-ID", "", true, ""},
+		{"no Message-ID", "", false, "required by servers that don't support UIDPLUS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newTestHandler(t, config.Mailbox{})
+			required, err := h.RequiresMessageID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !required {
+				t.Fatal("test server supports UIDPLUS, expected it to be missing")
+			}
+
+			info, body := writeMessage(t, tt.headers)
+			if tt.ensure {
+				// The message must be in a maildir folder, since it's rewritten through tmp/
+				dir := filepath.Dir(info.Filename)
+				md, err := maildir.New(dir)
+				if err == nil {
+					defer md.Close()
+					err = md.CreateFolder("INBOX")
+				}
+				if err == nil {
+					info.Filename = filepath.Join(dir, "INBOX", "new", "1.local.host")
+					err = ioutil.WriteFile(info.Filename, body, 0600)
+				}
+				if err == nil {
+					err = md.EnsureMessageID(info)
+				}
+				if err == nil {
+					body, err = ioutil.ReadFile(info.Filename)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mbox, err := user.GetMailbox("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// An older message with the same Message-ID must not be mistaken for the uploaded one
+			err = mbox.CreateMessage(nil, time.Now(), bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, err := mbox.Status([]imap.StatusItem{imap.StatusUidNext, imap.StatusMessages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := status.Messages
+
+			f, err := os.Open(info.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, err = h.AddMessage(&Upload{Info: info}, &literal.FileLiteral{File: f})
+
+			expected := messages + 1
+			if tt.err != "" {
+				expected = messages
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, expected it to contain %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if info.UID != int(status.UidNext) {
+				t.Errorf("got UID %d, expected %d", info.UID, status.UidNext)
+			}
+
+			status, err = mbox.Status([]imap.StatusItem{imap.StatusMessages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Messages != expected {
+				t.Errorf("folder contains %d messages, expected %d", status.Messages, expected)
+			}
+		})
+	}
+}
+
+// selectedStatusBackend is a memory backend that refuses STATUS on the selected folder,
+// which clients shouldn't use according to RFC 3501
+type selectedStatusBackend struct {
+	*memory.Backend
+}
+
+func (be *selectedStatusBackend) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+func (be *selectedStatusBackend) Command(name string) server.HandlerFactory {
+	if name == "STATUS" {
+		return func() server.Handler { return &selectedStatus{} }
+	}
+	return nil
+}
+
+type selectedStatus struct {
+	server.Status
+}
+
+func (cmd *selectedStatus) Handle(conn server.Conn) error {
+	if mbox := conn.Context().Mailbox; mbox != nil && mbox.Name() == cmd.Mailbox {
+		return errors.New("STATUS used on the selected folder")
+	}
+	return cmd.Status.Handle(conn)
+}
+
+func TestAddMessageSelectedFolder(t *testing.T) {
+	h, user := newTestBackendHandler(t, &selectedStatusBackend{Backend: memory.New()}, config.Mailbox{})
+	_, err := h.client.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A message added by another client after the folder was selected must not be mistaken for the uploaded one
+	info, body := writeMessage(t, "Message-ID: <selected@example.com>\r\n")
+	mbox, err := user.GetMailbox("INBOX")
+	if err == nil {
+		err = mbox.CreateMessage(nil, time.Now(), bytes.NewBuffer(body))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = h.AddMessage(&Upload{Info: info}, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.UID != int(status.UidNext) {
+		t.Errorf("got UID %d, expected %d", info.UID, status.UidNext)
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+	mtime := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		headers  string
+		expected time.Time
+	}{
+		{"Date", "Date: Thu, 14 Mar 2019 15:09:26 +0000\r\nReceived: from a by b; Fri, 15 Mar 2019 10:00:00 +0000\r\n",
+			time.Date(2019, time.March, 14, 15, 9, 26, 0, time.UTC)},
+		{"missing Date", "Received: from a by b; Fri, 15 Mar 2019 10:00:00 +0000\r\n",
+			time.Date(2019, time.March, 15, 10, 0, 0, 0, time.UTC)},
+		{"unparseable Date", "Date: sometime last week\r\nReceived: from a by b; Fri, 15 Mar 2019 10:00:00 +0000\r\n",
+			time.Date(2019, time.March, 15, 10, 0, 0, 0, time.UTC)},
+		{"unparseable Received", "Received: from a by b; yesterday\r\n", mtime},
+		{"no dates", "", mtime},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, _ := writeMessage(t, tt.headers)
+			err := os.Chtimes(info.Filename, mtime, mtime)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			date := messageDate(info.Filename)
+			if !date.Equal(tt.expected) {
+				t.Errorf("got date %v, expected %v", date, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Folder names are always handled as UTF-8 internally. The IMAP library encodes them
+// in modified UTF-7 (RFC 3501, section 5.1.3) when they're sent to the server, and decodes
+// them when they're returned by LIST. Note that UTF8=ACCEPT (RFC 6855) is never enabled,
+// since the library would then decode names that are already UTF-8.
+
+// decodeFolderName decodes a folder name written in modified UTF-7, e.g. "Entw&APw-rfe".
+// Names that don't contain any encoded characters, or that aren't valid modified UTF-7, are returned as-is
+func decodeFolderName(name string) string {
+	if !strings.Contains(name, "&") {
+		return name
+	}
+
+	decoded, err := utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return name
+	}
+	return decoded
+}
+
+// decodeFolderNames decodes a list of folder names, e.g. from the configuration
+func decodeFolderNames(names []string) []string {
+	if names == nil {
+		return nil
+	}
+
+	decoded := make([]string, len(names))
+	for i, name := range names {
+		decoded[i] = decodeFolderName(name)
+	}
+	return decoded
+}
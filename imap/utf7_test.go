@@ -0,0 +1,70 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/utf7"
+)
+
+func TestDecodeFolderName(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoded  string
+		expected string
+	}{
+		{"ascii", "INBOX/Sent", "INBOX/Sent"},
+		{"latin-1", "Entw&APw-rfe", "Entwürfe"},
+		{"latin-1 mixed", "&ANw-n&AO8-c&APY-d&AOk-", "Ünïcödé"},
+		{"cyrillic", "&BB4EQgQ,BEAEMAQyBDsENQQ9BD0ESwQ1-", "Отправленные"},
+		{"chinese", "&XfJT0ZAB-", "已发送"},
+		{"japanese", "&kAFP4W4IMH8w4TD8MOs-", "送信済みメール"},
+		{"hierarchy", "INBOX/&ZeVnLIqe-/&U,BTFw-", "INBOX/日本語/台北"},
+		{"literal ampersand", "Tom &- Jerry", "Tom & Jerry"},
+		{"literal ampersand and encoded", "&AMk-t&AOk- &- Hiver", "Été & Hiver"},
+
+		// Names that aren't valid modified UTF-7 are returned as-is
+		{"bare ampersand", "Tom & Jerry", "Tom & Jerry"},
+		{"unterminated", "&Jjo", "&Jjo"},
+		{"invalid base64", "&Jjo!", "&Jjo!"},
+		{"encoded ascii", "&AGE-", "&AGE-"},
+		{"utf-8", "Entwürfe", "Entwürfe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if decoded := decodeFolderName(tt.encoded); decoded != tt.expected {
+				t.Errorf("decodeFolderName(%q) = %q, expected %q", tt.encoded, decoded, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFolderNameRoundTrip(t *testing.T) {
+	names := []string{
+		"Entwürfe",
+		"Ünïcödé & Co",
+		"Отправленные",
+		"Входящие/Рассылки",
+		"已发送",
+		"送信済みメール",
+		"받은 편지함",
+		"Εισερχόμενα",
+		"דואר נכנס",
+		"Lists/🐹",
+		"Tom & Jerry",
+	}
+
+	for _, name := range names {
+		// Names are encoded by the IMAP library when they're sent to the server
+		encoded, err := utf7.Encoding.NewEncoder().String(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded := decodeFolderName(encoded); decoded != name {
+			t.Errorf("%q was encoded as %q, which decodes to %q", name, encoded, decoded)
+		}
+	}
+}
@@ -3,7 +3,12 @@
 // See COPYING at the root of the repository for details.
 package mail
 
-import "github.com/emersion/go-imap"
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
 
 /* Flags as defined by the maildir specification (https://cr.yp.to/proto/maildir.html)
 
@@ -55,3 +60,63 @@ func FlagsFromIMAP(s []string) (flags []string) {
 	}
 	return flags
 }
+
+// FlagsEqual returns true if both lists contain the same set of flags
+func FlagsEqual(a, b []string) bool {
+	return flagString(a) == flagString(b)
+}
+
+// MergeFlags performs a three-way merge of two sets of flags that both derive from 'base'.
+// Flags that have been added or removed on either side are added or removed in the result.
+// If 'base' is empty, the result is the union of 'local' and 'remote'.
+func MergeFlags(base, local, remote []string) []string {
+	result := make(map[string]bool)
+	for _, f := range base {
+		result[f] = true
+	}
+
+	for _, side := range [][]string{local, remote} {
+		added, removed := DiffFlags(base, side)
+		for _, f := range added {
+			result[f] = true
+		}
+		for _, f := range removed {
+			delete(result, f)
+		}
+	}
+
+	flags := make([]string, 0, len(result))
+	for f := range result {
+		flags = append(flags, f)
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// DiffFlags returns the flags that have been added and removed in 'newFlags' compared to 'oldFlags'
+func DiffFlags(oldFlags, newFlags []string) (added []string, removed []string) {
+	oldSet := make(map[string]bool)
+	for _, f := range oldFlags {
+		oldSet[f] = true
+	}
+	newSet := make(map[string]bool)
+	for _, f := range newFlags {
+		newSet[f] = true
+		if !oldSet[f] {
+			added = append(added, f)
+		}
+	}
+	for _, f := range oldFlags {
+		if !newSet[f] {
+			removed = append(removed, f)
+		}
+	}
+	return added, removed
+}
+
+// flagString returns a sorted string representation of a list of flags
+func flagString(flags []string) string {
+	sorted := append([]string(nil), flags...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, "")
+}
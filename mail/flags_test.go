@@ -0,0 +1,75 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package mail
+
+import (
+	"testing"
+)
+
+func TestMergeFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     []string
+		local    []string
+		remote   []string
+		expected []string
+	}{
+		{"unchanged", []string{FlagSeen}, []string{FlagSeen}, []string{FlagSeen}, []string{FlagSeen}},
+		{"added locally", []string{FlagSeen}, []string{FlagSeen, FlagFlagged}, []string{FlagSeen}, []string{FlagFlagged, FlagSeen}},
+		{"removed locally", []string{FlagSeen}, nil, []string{FlagSeen}, []string{}},
+		{"added on server", []string{FlagSeen}, []string{FlagSeen}, []string{FlagReplied, FlagSeen}, []string{FlagReplied, FlagSeen}},
+		{"removed on server", []string{FlagSeen, FlagFlagged}, []string{FlagSeen, FlagFlagged}, []string{FlagSeen}, []string{FlagSeen}},
+		{"added on both sides", []string{FlagSeen}, []string{FlagFlagged, FlagSeen}, []string{FlagFlagged, FlagSeen}, []string{FlagFlagged, FlagSeen}},
+		{"removed on both sides", []string{FlagFlagged, FlagSeen}, []string{FlagSeen}, []string{FlagSeen}, []string{FlagSeen}},
+		{"different flags on each side", []string{FlagSeen}, []string{FlagFlagged, FlagSeen}, []string{FlagReplied}, []string{FlagFlagged, FlagReplied}},
+		{"no base", nil, []string{FlagSeen}, []string{FlagFlagged}, []string{FlagFlagged, FlagSeen}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := MergeFlags(tt.base, tt.local, tt.remote)
+			if !FlagsEqual(flags, tt.expected) {
+				t.Errorf("got flags %v, expected %v", flags, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDiffFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		oldFlags []string
+		newFlags []string
+		added    []string
+		removed  []string
+	}{
+		{"unchanged", []string{FlagSeen}, []string{FlagSeen}, nil, nil},
+		{"added", []string{FlagSeen}, []string{FlagFlagged, FlagSeen}, []string{FlagFlagged}, nil},
+		{"removed", []string{FlagFlagged, FlagSeen}, []string{FlagSeen}, nil, []string{FlagFlagged}},
+		{"added and removed", []string{FlagSeen}, []string{FlagReplied}, []string{FlagReplied}, []string{FlagSeen}},
+		{"from nothing", nil, []string{FlagDraft}, []string{FlagDraft}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := DiffFlags(tt.oldFlags, tt.newFlags)
+			if !FlagsEqual(added, tt.added) || !FlagsEqual(removed, tt.removed) {
+				t.Errorf("got added %v and removed %v, expected %v and %v", added, removed, tt.added, tt.removed)
+			}
+		})
+	}
+}
+
+func TestFlagsIMAPKeywords(t *testing.T) {
+	// Keywords that can't be represented in the maildir are ignored
+	flags := FlagsFromIMAP([]string{"\\Seen", "$Label1", "\\Flagged"})
+	if !FlagsEqual(flags, []string{FlagFlagged, FlagSeen}) {
+		t.Errorf("got flags %v, expected FS", flags)
+	}
+
+	imapFlags := FlagsToIMAP([]string{FlagPassed, FlagSeen})
+	if len(imapFlags) != 2 || imapFlags[0] != "$Forwarded" || imapFlags[1] != "\\Seen" {
+		t.Errorf("got IMAP flags %v, expected [$Forwarded \\Seen]", imapFlags)
+	}
+}
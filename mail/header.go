@@ -0,0 +1,58 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package mail
+
+import (
+	"bufio"
+	"io"
+	netmail "net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReadHeader parses the header of a message
+func ReadHeader(r io.Reader) (netmail.Header, error) {
+	msg, err := netmail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// ReadFileHeader parses the header of a message stored in a file
+func ReadFileHeader(filename string) (netmail.Header, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ReadHeader(fd)
+}
+
+// MessageID returns the Message-ID of a message, without surrounding brackets
+func MessageID(header netmail.Header) string {
+	id := strings.TrimSpace(header.Get("Message-Id"))
+	return strings.Trim(id, "<>")
+}
+
+// Date returns the date of a message, from the Date header, or if that's missing,
+// from the most recent Received header, which is added when the message is delivered
+func Date(header netmail.Header) (time.Time, error) {
+	t, err := header.Date()
+	if err == nil {
+		return t, nil
+	}
+
+	for _, received := range header["Received"] {
+		pos := strings.LastIndex(received, ";")
+		if pos == -1 {
+			continue
+		}
+		if t, e := netmail.ParseDate(strings.TrimSpace(received[pos+1:])); e == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
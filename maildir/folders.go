@@ -0,0 +1,202 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// foldersFilename is the name of the file used to keep track of which folders have been synchronized
+const foldersFilename = ".imap-sync-folders"
+
+// Folders returns the names of all local folders
+func (m *Maildir) Folders() ([]string, error) {
+	var folders []string
+	err := filepath.Walk(m.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if m.skipDir(path, info.Name()) {
+			return filepath.SkipDir
+		}
+		if !isFolderDir(path) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(m.path, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." && m.layout != LayoutMaildirPP {
+			// Only the Maildir++ layout stores a folder in the maildir itself
+			return nil
+		}
+		if name, ok := m.folderNameFromPath(relPath); ok {
+			folders = append(folders, name)
+		}
+		return nil
+	})
+	return folders, err
+}
+
+// knownFolders is the contents of the file used to keep track of which folders have been synchronized.
+// How folder names were mapped to directories is recorded as well, since the local folders can only be
+// compared to the known folders as long as that hasn't changed
+type knownFolders struct {
+	Layout    string            `json:"layout"`
+	Delimiter string            `json:"delimiter"`
+	FolderMap map[string]string `json:"folder_map,omitempty"`
+	Folders   map[string]int    `json:"folders"`
+}
+
+// KnownFolders returns the folders that existed on both sides at the last sync,
+// together with their UID validity. This is used to tell new folders apart from
+// folders that have been renamed or deleted on one side.
+// 'sameLayout' is false if the folders were recorded with another layout or folder map,
+// in which case local folders might be stored somewhere else than they used to
+func (m *Maildir) KnownFolders() (folders map[string]int, sameLayout bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(m.path, foldersFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]int), true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var known knownFolders
+	err = json.Unmarshal(data, &known)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot parse %s: %w", foldersFilename, err)
+	}
+	if known.Folders == nil {
+		known.Folders = make(map[string]int)
+	}
+	return known.Folders, known.Layout == m.layout && known.Delimiter == m.delimiter && sameFolderMap(known.FolderMap, m.toLocal), nil
+}
+
+// sameFolderMap returns true if two folder maps are equal
+func sameFolderMap(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SetKnownFolders records the folders that exist on both sides, together with the current layout
+func (m *Maildir) SetKnownFolders(folders map[string]int) error {
+	data, err := json.Marshal(knownFolders{
+		Layout:    m.layout,
+		Delimiter: m.delimiter,
+		FolderMap: m.toLocal,
+		Folders:   folders,
+	})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(m.path, foldersFilename)
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// closeState closes the state of a folder, if it's open, and removes it from the cache.
+// If 'save' is false, the state is discarded without being compacted
+func (m *Maildir) closeState(folderName string, save bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.states[folderName]
+	if !ok {
+		return nil
+	}
+	delete(m.states, folderName)
+	if !save {
+		return s.discard()
+	}
+	return s.Close()
+}
+
+// RenameFolder renames a local folder, together with its synchronization state
+func (m *Maildir) RenameFolder(oldName, newName string) error {
+	err := m.closeState(oldName, true)
+	if err != nil {
+		return err
+	}
+
+	newPath := m.folderPath(newName)
+	if _, err = os.Stat(newPath); err == nil {
+		return fmt.Errorf("cannot rename folder %s to %s: folder already exists", oldName, newName)
+	}
+
+	err = os.MkdirAll(filepath.Dir(newPath), 0700)
+	if err != nil {
+		return err
+	}
+	return os.Rename(m.folderPath(oldName), newPath)
+}
+
+// RemoveFolder removes a local folder, and all messages in it.
+// Subfolders are left untouched, so the directory itself is only removed if it's empty afterwards.
+// This is also used to forget the state of a folder that has already been removed
+func (m *Maildir) RemoveFolder(folderName string) error {
+	err := m.closeState(folderName, false)
+	if err != nil {
+		return err
+	}
+
+	folderPath := m.folderPath(folderName)
+	for _, name := range []string{"cur", "new", "tmp", stateFilename} {
+		err = os.RemoveAll(filepath.Join(folderPath, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	if folderPath != m.path {
+		// Fails if there are subfolders, which is fine
+		os.Remove(folderPath)
+	}
+	return nil
+}
+
+// DetachFolder marks all messages in a folder as not synchronized, and clears the folder state.
+// This is used when a folder is recreated on the server, so that the messages are uploaded again
+func (m *Maildir) DetachFolder(folderName string) error {
+	s, err := m.State(folderName)
+	if err != nil {
+		return err
+	}
+
+	messages, err := m.ListMessages(folderName)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range messages {
+		if info.UID == 0 {
+			continue
+		}
+
+		_, err = m.DetachMessage(info)
+		if err != nil {
+			return err
+		}
+	}
+	return s.Reset(0)
+}
@@ -0,0 +1,268 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Layouts describe how IMAP folder names are mapped to directories in the maildir
+const (
+	// LayoutVerbatim uses the folder name as the path, so that only '/' creates subdirectories.
+	// This is the default, and how folders have always been stored. Only "." and ".." are escaped,
+	// so that folders can't escape the maildir, a leading '.', so that folders aren't hidden,
+	// and "cur", "new" and "tmp", so that subfolders aren't mixed up with the messages of their parent
+	LayoutVerbatim = "verbatim"
+	// LayoutFS stores each level of the folder hierarchy in a subdirectory,
+	// e.g. "INBOX.Sent" becomes INBOX/Sent if the server uses '.' as the hierarchy delimiter
+	LayoutFS = "fs"
+	// LayoutMaildirPP is the Maildir++ layout, where INBOX is stored in the maildir itself,
+	// and other folders in directories named after the folder with '.' as delimiter, e.g. ".Lists.Go"
+	LayoutMaildirPP = "maildir++"
+)
+
+// inboxName is the name of the INBOX, which is stored in the maildir itself in the Maildir++ layout
+const inboxName = "INBOX"
+
+// SetLayout sets how folder names are mapped to directories.
+// 'delimiter' is the hierarchy delimiter used by the server, as reported by LIST
+func (m *Maildir) SetLayout(layout string, delimiter string) error {
+	switch layout {
+	case "":
+		layout = LayoutVerbatim
+	case LayoutVerbatim, LayoutFS, LayoutMaildirPP:
+	default:
+		return fmt.Errorf("unknown maildir layout %q", layout)
+	}
+
+	m.layout = layout
+	m.delimiter = delimiter
+	return nil
+}
+
+// SetFolderMap sets the local names used for server folders that shouldn't be stored under their own name.
+// 'folderMap' maps server folder names to local folder names. All other methods take server folder names
+func (m *Maildir) SetFolderMap(folderMap map[string]string) error {
+	toLocal := make(map[string]string)
+	toServer := make(map[string]string)
+	for serverName, localName := range folderMap {
+		if localName == "" {
+			return fmt.Errorf("no local folder configured for %s", serverName)
+		}
+		if other, ok := toServer[localName]; ok {
+			return fmt.Errorf("folders %s and %s are both mapped to local folder %s", other, serverName, localName)
+		}
+		toLocal[serverName] = localName
+		toServer[localName] = serverName
+	}
+
+	m.toLocal = toLocal
+	m.toServer = toServer
+	return nil
+}
+
+// localName returns the local name of a server folder
+func (m *Maildir) localName(folderName string) string {
+	if name, ok := m.toLocal[folderName]; ok {
+		return name
+	}
+	return folderName
+}
+
+// serverName returns the server name of a local folder.
+// false is returned if the local folder is hidden, because its name is mapped to another local folder
+func (m *Maildir) serverName(localName string) (string, bool) {
+	if name, ok := m.toServer[localName]; ok {
+		return name, true
+	}
+	if _, ok := m.toLocal[localName]; ok {
+		return "", false
+	}
+	return localName, true
+}
+
+// hierarchy splits a folder name into the levels of the folder hierarchy
+func (m *Maildir) hierarchy(folderName string) []string {
+	delimiter := m.delimiter
+	if m.layout == LayoutVerbatim {
+		delimiter = "/"
+	}
+	if delimiter == "" {
+		return []string{folderName}
+	}
+	return strings.Split(folderName, delimiter)
+}
+
+// folderPath returns the directory used to store a folder
+func (m *Maildir) folderPath(folderName string) string {
+	return filepath.Join(m.path, m.relFolderPath(m.localName(folderName)))
+}
+
+// relFolderPath returns the directory used to store a folder, relative to the maildir
+func (m *Maildir) relFolderPath(folderName string) string {
+	levels := m.hierarchy(folderName)
+
+	if m.layout == LayoutMaildirPP {
+		if strings.EqualFold(folderName, inboxName) {
+			return "."
+		}
+		for i := range levels {
+			levels[i] = escapeFolderName(levels[i], ".")
+		}
+		return "." + strings.Join(levels, ".")
+	}
+
+	for i := range levels {
+		if m.layout == LayoutVerbatim {
+			levels[i] = escapeRelativeName(levels[i])
+		} else if escaped, ok := escapeReservedName(levels[i]); ok {
+			levels[i] = escaped
+		} else {
+			levels[i] = escapeFolderName(levels[i], "")
+		}
+	}
+	return filepath.Join(levels...)
+}
+
+// folderNameFromPath returns the server name of the folder stored in a directory, relative to the maildir.
+// false is returned if the directory isn't used, because the folder is mapped to another directory
+func (m *Maildir) folderNameFromPath(relPath string) (string, bool) {
+	var levels []string
+	if m.layout == LayoutMaildirPP {
+		if relPath == "." || relPath == "" {
+			return m.serverName(inboxName)
+		}
+		levels = strings.Split(strings.TrimPrefix(relPath, "."), ".")
+	} else {
+		levels = strings.Split(filepath.ToSlash(relPath), "/")
+	}
+
+	for i := range levels {
+		if m.layout == LayoutVerbatim {
+			levels[i] = unescapeRelativeName(levels[i])
+		} else {
+			levels[i] = unescapeFolderName(levels[i])
+		}
+	}
+
+	delimiter := m.delimiter
+	if m.layout == LayoutVerbatim {
+		delimiter = "/"
+	}
+	return m.serverName(strings.Join(levels, delimiter))
+}
+
+// skipDir returns true if a directory found while walking the maildir can't contain any folders
+func (m *Maildir) skipDir(path string, name string) bool {
+	if path == m.path {
+		return false
+	}
+	if name == "cur" || name == "new" || name == "tmp" {
+		return true
+	}
+	if name[0] != '.' {
+		return false
+	}
+
+	// Folders are stored in dot-directories at the top level in the Maildir++ layout
+	return m.layout != LayoutMaildirPP || filepath.Dir(path) != m.path
+}
+
+// isFolderDir returns true if a directory contains a folder
+func isFolderDir(path string) bool {
+	st, err := os.Stat(filepath.Join(path, "cur"))
+	return err == nil && st.IsDir()
+}
+
+// escapeFolderName escapes a single level of a folder name, so that it can be used as a directory name.
+// Path separators, '%' and any characters in 'special' are percent-encoded, as is a leading '.',
+// so that folders can't escape the maildir, or be mistaken for hidden files
+func escapeFolderName(name string, special string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		if r == '%' || r == '/' || r == os.PathSeparator || strings.ContainsRune(special, r) || (i == 0 && r == '.') {
+			fmt.Fprintf(&sb, "%%%02X", r)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// reservedNames are the subdirectories of a maildir folder, which can't be used as names of subfolders
+var reservedNames = map[string]string{
+	"cur": "%63ur",
+	"new": "%6Eew",
+	"tmp": "%74mp",
+}
+
+// escapeReservedName escapes a level of a folder name that would be mistaken for one of the subdirectories of its parent
+func escapeReservedName(name string) (string, bool) {
+	escaped, ok := reservedNames[name]
+	return escaped, ok
+}
+
+// unescapeReservedName reverses escapeReservedName
+func unescapeReservedName(name string) (string, bool) {
+	for reserved, escaped := range reservedNames {
+		if name == escaped {
+			return reserved, true
+		}
+	}
+	return name, false
+}
+
+// escapeRelativeName escapes a level of a folder name that refers to the current or parent directory,
+// or to one of the subdirectories of the parent folder. A leading '.' is escaped as well, since
+// dot-directories are skipped when looking for folders
+func escapeRelativeName(name string) string {
+	if name == "." || name == ".." {
+		return strings.Repeat("%2E", len(name))
+	}
+	if strings.HasPrefix(name, ".") {
+		return "%2E" + name[1:]
+	}
+	if escaped, ok := escapeReservedName(name); ok {
+		return escaped
+	}
+	return name
+}
+
+// unescapeRelativeName reverses escapeRelativeName
+func unescapeRelativeName(name string) string {
+	if name == "%2E%2E" {
+		return ".."
+	}
+	if strings.HasPrefix(name, "%2E") {
+		return "." + name[3:]
+	}
+	if reserved, ok := unescapeReservedName(name); ok {
+		return reserved
+	}
+	return name
+}
+
+// unescapeFolderName reverses escapeFolderName
+func unescapeFolderName(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			if b, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+				sb.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		sb.WriteByte(name[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,146 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFolderPath(t *testing.T) {
+	tests := []struct {
+		layout    string
+		delimiter string
+		name      string
+		path      string
+	}{
+		// Folders have always been stored verbatim, so existing directories must not change
+		{LayoutVerbatim, ".", "INBOX", "INBOX"},
+		{LayoutVerbatim, ".", "INBOX.Sent", "INBOX.Sent"},
+		{LayoutVerbatim, "/", "Lists/Go", "Lists/Go"},
+		{LayoutVerbatim, "/", "100%", "100%"},
+		{LayoutVerbatim, "/", ".hidden", "%2Ehidden"},
+		{LayoutVerbatim, "/", "A/.b", "A/%2Eb"},
+		{LayoutVerbatim, ".", "..x", "%2E.x"},
+		{LayoutVerbatim, "/", "..", "%2E%2E"},
+		{LayoutVerbatim, "/", "../../etc", "%2E%2E/%2E%2E/etc"},
+		{LayoutVerbatim, "/", "a/./b", "a/%2E/b"},
+		{LayoutVerbatim, "/", "Archive/new", "Archive/%6Eew"},
+		{LayoutVerbatim, "/", "cur", "%63ur"},
+		{LayoutVerbatim, ".", "INBOX.tmp", "INBOX.tmp"},
+
+		{LayoutFS, ".", "INBOX.Sent", "INBOX/Sent"},
+		{LayoutFS, ".", "a/b", "a%2Fb"},
+		{LayoutFS, "/", "100%", "100%25"},
+		{LayoutFS, "/", "../x", "%2E./x"},
+		{LayoutFS, ".", "INBOX.tmp", "INBOX/%74mp"},
+		{LayoutFS, "/", "Archive/cur/new", "Archive/%63ur/%6Eew"},
+
+		{LayoutMaildirPP, ".", "INBOX", "."},
+		{LayoutMaildirPP, "/", "Lists/Go", ".Lists.Go"},
+		{LayoutMaildirPP, "/", "v1.0", ".v1%2E0"},
+		{LayoutMaildirPP, "/", "Archive/new", ".Archive.new"},
+	}
+
+	for _, tt := range tests {
+		m := &Maildir{path: "/maildir"}
+		err := m.SetLayout(tt.layout, tt.delimiter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := m.relFolderPath(tt.name)
+		if path != filepath.FromSlash(tt.path) {
+			t.Errorf("%s layout: folder %q is stored in %q, expected %q", tt.layout, tt.name, path, tt.path)
+			continue
+		}
+
+		name, ok := m.folderNameFromPath(path)
+		if !ok || name != tt.name {
+			t.Errorf("%s layout: directory %q contains folder %q, expected %q", tt.layout, path, name, tt.name)
+		}
+	}
+}
+
+func TestReservedFolderNames(t *testing.T) {
+	for _, layout := range []string{LayoutVerbatim, LayoutFS, LayoutMaildirPP} {
+		dir, err := ioutil.TempDir("", "imap-sync-layout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		m, err := New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		err = m.SetLayout(layout, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"Archive", "Archive/cur", "Archive/new", "Archive/tmp"}
+		for _, name := range expected {
+			err = m.CreateFolder(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		folders, err := m.Folders()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(folders)
+		if strings.Join(folders, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s layout: got folders %v, expected %v", layout, folders, expected)
+		}
+
+		messages, err := m.ListMessages("Archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 0 {
+			t.Errorf("%s layout: folder Archive contains %d messages, expected none", layout, len(messages))
+		}
+	}
+}
+
+func TestHiddenFolderNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imap-sync-layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// Folders starting with a dot would otherwise be stored in dot-directories, which aren't listed,
+	// so they would look like they had been deleted locally
+	expected := []string{".hidden", "A", "A/.b", "INBOX"}
+	for _, name := range expected {
+		err = m.CreateFolder(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	folders, err := m.Folders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(folders)
+	if strings.Join(folders, ",") != strings.Join(expected, ",") {
+		t.Errorf("got folders %v, expected %v", folders, expected)
+	}
+}
@@ -4,15 +4,16 @@
 package maildir
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -22,7 +23,11 @@ import (
 // SyncUUID is used to identify files that has been created by us
 const SyncUUID = "7f4f3b23-ad6c-434d-9fa9-dbfa7a51397e"
 
-// Maildir keeps track of messages in a mail dir
+// DefaultPollInterval is used when polling the maildir or the server for changes, if no interval has been configured
+const DefaultPollInterval = time.Minute
+
+// Maildir keeps track of messages in a mail dir.
+// It is safe for concurrent use, as long as each folder is only synchronized by one goroutine at a time
 type Maildir struct {
 	path       string
 	hostname   string
@@ -30,12 +35,27 @@ type Maildir struct {
 	startTime  time.Time
 	seqNumChan <-chan int
 	done       chan bool
+
+	layout    string // How folder names are mapped to directories
+	delimiter string // Hierarchy delimiter used by the server
+
+	include func(folderName string) bool // Decides which folders are scanned for new messages
+
+	toLocal  map[string]string // Server folder names mapped to other local folder names
+	toServer map[string]string // The reverse of toLocal
+
+	mu     sync.Mutex // Protects states
+	states map[string]*FolderState
 }
 
 // New creates a new maildir instance that can be used to track messages
 func New(maildirPath string) (*Maildir, error) {
 	var err error
-	m := &Maildir{path: maildirPath}
+	m := &Maildir{
+		path:   maildirPath,
+		layout: LayoutVerbatim,
+		states: make(map[string]*FolderState),
+	}
 
 	m.hostname, err = os.Hostname()
 	if err != nil {
@@ -66,8 +86,8 @@ func New(maildirPath string) (*Maildir, error) {
 // CreateMailDir creates new directories to store maildir entries in
 // with the correct subfolders and permissions
 func (m *Maildir) CreateFolder(folderName string) error {
-	folderPath := filepath.Join(m.path, folderName)
-	if st, err := os.Stat(folderPath); err == nil {
+	folderPath := m.folderPath(folderName)
+	if st, err := os.Stat(filepath.Join(folderPath, "cur")); err == nil {
 		if !st.IsDir() {
 			return fmt.Errorf("path %s is not a directory", folderPath)
 		}
@@ -95,102 +115,103 @@ func (m *Maildir) CreateFolder(folderName string) error {
 	return nil
 }
 
-// Close cleans up the maildir instance
-func (m *Maildir) Close() {
+// Close cleans up the maildir instance, and writes the synchronization state to disk
+func (m *Maildir) Close() error {
 	// cleanup goroutine
 	close(m.done)
-}
 
-// GetLastUID updates our uid validity-file for the specific folder
-func (m *Maildir) GetLastUID(folderName string) (uidValidity int, uid int, err error) {
-	uidValidityFd, err := os.Open(filepath.Join(m.path, folderName, ".uidvalidity"))
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return 0, 0, nil
-		}
-		return 0, 0, err
-	}
-	defer uidValidityFd.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	scanner := bufio.NewScanner(uidValidityFd)
-	var intList [2]int
-	for row := 0; scanner.Scan() && row < 2; row++ {
-		intList[row], err = strconv.Atoi(scanner.Text())
-		if err != nil {
-			return 0, 0, err
+	var err error
+	for folderName, s := range m.states {
+		if closeErr := s.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("cannot save state for folder %s: %w", folderName, closeErr)
 		}
 	}
-	if err = scanner.Err(); err != nil {
-		return 0, 0, err
-	}
-
-	return intList[0], intList[1], nil
+	m.states = nil
+	return err
 }
 
-// UpdateUIDValidity updates our uid validity-file for the specific folder
-func (m *Maildir) updateUIDValidity(info mail.Info) error {
-	uidValidityFd, err := os.OpenFile(filepath.Join(m.path, info.FolderName, ".uidvalidity"), os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+// State returns the synchronization state of a folder
+func (m *Maildir) State(folderName string) (*FolderState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.states[folderName]; ok {
+		return s, nil
 	}
-	defer uidValidityFd.Close()
 
-	_, err = fmt.Fprintln(uidValidityFd, info.UIDValidity)
+	s, err := m.openState(folderName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	m.states[folderName] = s
+	return s, nil
+}
 
-	_, err = fmt.Fprintln(uidValidityFd, info.UID)
+// GetLastUID returns the UID validity and the highest UID seen for the specific folder
+func (m *Maildir) GetLastUID(folderName string) (uidValidity int, uid int, err error) {
+	s, err := m.State(folderName)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	return nil
+	return s.UIDValidity(), s.LastUID(), nil
 }
 
-// HasMessage returns true if the message exists, and false if it doesn't
-func (m *Maildir) HasMessage(folderName string, info mail.Info) (bool, error) {
-	uidValidityFd, err := os.Open(filepath.Join(folderName, ".uidvalidity"))
+// recordMessage updates the synchronization state of the folder with a synced message
+func (m *Maildir) recordMessage(info mail.Info) error {
+	s, err := m.State(info.FolderName)
 	if err != nil {
-		if err == os.ErrNotExist {
-			return false, nil
-		}
-		return false, err
+		return err
 	}
-	defer uidValidityFd.Close()
 
-	scanner := bufio.NewScanner(uidValidityFd)
-	var intList [2]int
-	for row := 0; scanner.Scan() && row < 2; row++ {
-		intList[row], err = strconv.Atoi(scanner.Text())
+	switch s.UIDValidity() {
+	case info.UIDValidity:
+	case 0:
+		err = s.SetUIDValidity(info.UIDValidity, s.LastUID())
 		if err != nil {
-			return false, err
+			return err
 		}
+	default:
+		// The UID validity of the folder has changed, and the state will be replaced once
+		// we've recovered from it. Until then, the UID refers to a message we don't know about
+		return nil
 	}
-	if err = scanner.Err(); err != nil {
+
+	return s.SetMessage(info.UID, MessageState{
+		Filename: info.Filename,
+		Flags:    info.Flags,
+	})
+}
+
+// HasMessage returns true if the message has been synchronized, and false if it hasn't
+func (m *Maildir) HasMessage(folderName string, info mail.Info) (bool, error) {
+	s, err := m.State(folderName)
+	if err != nil {
 		return false, err
 	}
 
-	if intList[0] != info.UIDValidity {
-		return false, errors.New("uid validity has changed - not implemented")
+	if s.UIDValidity() != info.UIDValidity {
+		return false, nil
 	}
-	return info.UID > intList[1], nil
+	_, ok := s.Message(info.UID)
+	return ok, nil
 }
 
 // AddMessage adds a message to a folder, and updates the uidvalidity flags
 func (m *Maildir) AddMessage(info mail.Info, contents imap.Literal) (mail.Info, error) {
 	sort.Strings(info.Flags)
-	flags := strings.Join(info.Flags, "")
 
-	filename := fmt.Sprintf("%d.P%dQ%dS%s.%s,U=%d:2,%s",
-		m.startTime.Unix(),
-		m.processID,
-		<-m.seqNumChan,
-		SyncUUID,
-		m.hostname,
-		info.UID,
-		flags)
-	mailboxPath := filepath.Join(m.path, info.FolderName)
-	tmpPath := filepath.Join(mailboxPath, "tmp", filename)
+	// Messages that haven't been seen are delivered to new/, so that they're shown as new mail
+	dir := dirNew
+	for _, f := range info.Flags {
+		if f == mail.FlagSeen {
+			dir = dirCur
+		}
+	}
+	newPath := m.messagePath(info.FolderName, dir, info.UID, info.Flags)
+	tmpPath := filepath.Join(m.folderPath(info.FolderName), "tmp", filepath.Base(newPath))
 
 	fd, err := os.Create(tmpPath)
 	if err != nil {
@@ -206,7 +227,6 @@ func (m *Maildir) AddMessage(info mail.Info, contents imap.Literal) (mail.Info,
 	}
 	fd.Close()
 
-	newPath := filepath.Join(mailboxPath, "cur", filename)
 	err = os.Rename(tmpPath, newPath)
 	if err != nil {
 		// Could not rename file - discard old entry to avoid duplicates
@@ -214,45 +234,210 @@ func (m *Maildir) AddMessage(info mail.Info, contents imap.Literal) (mail.Info,
 		return info, err
 	}
 
-	err = m.updateUIDValidity(info)
+	info.Filename = newPath
+	err = m.recordMessage(info)
 	if err != nil {
-		// Could not update UID validity, remove the new file to avoid duplicates
+		// Could not update state, remove the new file to avoid duplicates
 		os.Remove(newPath)
 		return info, err
 	}
 
+	// Only downloaded messages advance the last seen UID
+	s, err := m.State(info.FolderName)
+	if err == nil && s.UIDValidity() == info.UIDValidity && info.UID > s.LastUID() {
+		err = s.SetUIDValidity(info.UIDValidity, info.UID)
+	}
+	return info, err
+}
+
+// RemoveMessage deletes a synchronized message from disk, and from the folder state
+func (m *Maildir) RemoveMessage(info mail.Info) error {
+	err := os.Remove(info.Filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return m.ForgetMessage(info)
+}
+
+// TrashMessage moves a synchronized message to another folder, and removes it from the folder state.
+// The message is tagged as synced, but without a UID, so it's kept locally instead of being uploaded to the
+// trash folder. Servers usually move deleted messages to the trash folder themselves.
+func (m *Maildir) TrashMessage(info mail.Info, trashFolder string) error {
+	err := m.CreateFolder(trashFolder)
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(info.Flags)
+	newPath := filepath.Join(m.folderPath(trashFolder), dirCur, m.messageFilename(0, info.Flags))
+
+	err = os.Rename(info.Filename, newPath)
+	if err != nil {
+		return err
+	}
+	return m.ForgetMessage(info)
+}
+
+// DetachMessage marks a message as not synchronized, so that it's uploaded again.
+// The folder state is not updated, so this should only be used for messages that are not part of it
+func (m *Maildir) DetachMessage(info mail.Info) (mail.Info, error) {
+	sort.Strings(info.Flags)
+	newPath := filepath.Join(m.folderPath(info.FolderName), dirCur, m.unsyncedFilename(info.Flags))
+	err := os.Rename(info.Filename, newPath)
+	if err != nil {
+		return info, err
+	}
+
 	info.Filename = newPath
+	info.UIDValidity = 0
+	info.UID = 0
 	return info, nil
 }
 
-// RenameMessage renames a message from the current name to the expected imap-sync name
-// This also tags the file as synced
-func (m *Maildir) RenameMessage(info mail.Info) (mail.Info, error) {
-	sort.Strings(info.Flags)
-	flags := strings.Join(info.Flags, "")
+// ForgetMessage removes a message from the folder state, without touching the file
+func (m *Maildir) ForgetMessage(info mail.Info) error {
+	s, err := m.State(info.FolderName)
+	if err != nil {
+		return err
+	}
+	return s.RemoveMessage(info.UID)
+}
 
-	filename := fmt.Sprintf("%d.P%dQ%dS%s.%s,U=%d:2,%s",
+// unsyncedFilename generates a new unique filename for a message that hasn't been synced
+func (m *Maildir) unsyncedFilename(flags []string) string {
+	return fmt.Sprintf("%d.P%dQ%d.%s:2,%s",
+		m.startTime.Unix(),
+		m.processID,
+		<-m.seqNumChan,
+		m.hostname,
+		strings.Join(flags, ""))
+}
+
+// messageFilename generates a new unique filename for a message, tagged as synced
+func (m *Maildir) messageFilename(uid int, flags []string) string {
+	return fmt.Sprintf("%d.P%dQ%dS%s.%s,U=%d:2,%s",
 		m.startTime.Unix(),
 		m.processID,
 		<-m.seqNumChan,
 		SyncUUID,
 		m.hostname,
-		info.UID,
-		flags)
-	mailboxPath := filepath.Join(m.path, info.FolderName)
-	newPath := filepath.Join(mailboxPath, "cur", filename)
+		uid,
+		strings.Join(flags, ""))
+}
+
+// Subdirectories of a maildir folder that contain messages.
+// Messages that haven't been seen by the user are delivered to new/, and moved to cur/ once they have been processed
+const (
+	dirCur = "cur"
+	dirNew = "new"
+)
+
+// messageDir returns the subdirectory a message file is stored in
+func messageDir(filename string) string {
+	if filepath.Base(filepath.Dir(filename)) == dirNew {
+		return dirNew
+	}
+	return dirCur
+}
+
+// messagePath generates a new path for a message tagged as synced, in either cur/ or new/.
+// Files in new/ don't have an info part, unless there are flags that would otherwise be lost
+func (m *Maildir) messagePath(folderName string, dir string, uid int, flags []string) string {
+	filename := m.messageFilename(uid, flags)
+	if dir == dirNew && len(flags) == 0 {
+		filename = strings.TrimSuffix(filename, ":2,")
+	}
+	return filepath.Join(m.folderPath(folderName), dir, filename)
+}
+
+// RenameMessage renames a message from the current name to the expected imap-sync name
+// This also tags the file as synced. If the message is already tagged as synced
+// with the same UID, only the flags part of the filename is updated.
+// Messages in new/ that are tagged as synced here, i.e. after they have been uploaded, have now been processed,
+// and are moved to cur/. Messages downloaded to new/ stay there until they have been seen, so that they're
+// still shown as new mail
+func (m *Maildir) RenameMessage(info mail.Info) (mail.Info, error) {
+	sort.Strings(info.Flags)
+
+	var filename string
+	dir := dirCur
+	base := filepath.Base(info.Filename)
+	if IsSynced(base) && parseFileUID(base) == info.UID {
+		if messageDir(info.Filename) == dirNew {
+			dir = dirNew
+			for _, f := range info.Flags {
+				if f == mail.FlagSeen {
+					dir = dirCur
+				}
+			}
+		}
+		if pos := strings.Index(base, ":2,"); pos > -1 {
+			base = base[:pos]
+		}
+		filename = base + ":2," + strings.Join(info.Flags, "")
+	} else {
+		filename = m.messageFilename(info.UID, info.Flags)
+	}
+	if dir == dirNew && len(info.Flags) == 0 {
+		filename = strings.TrimSuffix(filename, ":2,")
+	}
+	newPath := filepath.Join(m.folderPath(info.FolderName), dir, filename)
 
 	err := os.Rename(info.Filename, newPath)
 	if err != nil {
 		return info, err
 	}
-	err = m.updateUIDValidity(info)
+	oldPath := info.Filename
+	info.Filename = newPath
+	err = m.recordMessage(info)
 	if err != nil {
-		// Could not update UID validity, move file back to avoid inconsistency
-		os.Rename(newPath, info.Filename)
+		// Could not update state, move file back to avoid inconsistency
+		os.Rename(newPath, oldPath)
+		info.Filename = oldPath
 		return info, err
 	}
+	return info, nil
+}
 
-	info.Filename = newPath
-	return info, err
+// EnsureMessageID adds a Message-ID header to a message that doesn't have one.
+// The file is rewritten through tmp/, and keeps its name and modification time
+func (m *Maildir) EnsureMessageID(info mail.Info) error {
+	data, err := ioutil.ReadFile(info.Filename)
+	if err != nil {
+		return err
+	}
+
+	header, err := mail.ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if mail.MessageID(header) != "" {
+		return nil
+	}
+
+	st, err := os.Stat(info.Filename)
+	if err != nil {
+		return err
+	}
+
+	// Use the same line endings as the rest of the message
+	newline := "\n"
+	if pos := bytes.IndexByte(data, '\n'); pos > 0 && data[pos-1] == '\r' {
+		newline = "\r\n"
+	}
+	messageID := fmt.Sprintf("Message-ID: <%d.P%dQ%d@%s>%s", time.Now().UnixNano(), m.processID, <-m.seqNumChan, m.hostname, newline)
+
+	tmpPath := filepath.Join(m.folderPath(info.FolderName), "tmp", m.unsyncedFilename(nil))
+	err = ioutil.WriteFile(tmpPath, append([]byte(messageID), data...), st.Mode().Perm())
+	if err == nil {
+		err = os.Chtimes(tmpPath, st.ModTime(), st.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, info.Filename)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
 }
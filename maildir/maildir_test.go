@@ -0,0 +1,83 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yzzyx/imap-sync/mail"
+)
+
+func TestRenameMessage(t *testing.T) {
+	tests := []struct {
+		dir    string   // Subdirectory the message is stored in
+		synced bool     // Message has been downloaded, rather than uploaded
+		flags  []string // Flags of the message
+		newDir string   // Expected subdirectory after the rename
+		suffix string   // Expected end of the filename after the rename
+	}{
+		// Uploaded messages have been processed
+		{dirNew, false, nil, dirCur, ",U=1:2,"},
+		{dirNew, false, []string{mail.FlagFlagged}, dirCur, ",U=2:2,F"},
+		{dirNew, false, []string{mail.FlagSeen, mail.FlagFlagged}, dirCur, ",U=3:2,FS"},
+		{dirCur, false, nil, dirCur, ",U=4:2,"},
+		{dirCur, false, []string{mail.FlagSeen}, dirCur, ",U=5:2,S"},
+
+		// Downloaded messages are still new until they have been seen
+		{dirNew, true, nil, dirNew, ",U=6"},
+		{dirNew, true, []string{mail.FlagFlagged}, dirNew, ",U=7:2,F"},
+		{dirNew, true, []string{mail.FlagSeen}, dirCur, ",U=8:2,S"},
+		{dirCur, true, nil, dirCur, ",U=9:2,"},
+	}
+
+	dir, err := ioutil.TempDir("", "imap-sync-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	err = m.CreateFolder("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range tests {
+		filename := filepath.Join(dir, "INBOX", tt.dir, fmt.Sprintf("%d.local.host", i+1))
+		if tt.synced {
+			filename = m.messagePath("INBOX", tt.dir, i+1, nil)
+		}
+		err = ioutil.WriteFile(filename, []byte("Subject: test\r\n\r\ntest\r\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := m.RenameMessage(mail.Info{
+			FolderName:  "INBOX",
+			Filename:    filename,
+			UIDValidity: 1,
+			UID:         i + 1,
+			Flags:       tt.flags,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messageDir(info.Filename); got != tt.newDir || !strings.HasSuffix(info.Filename, tt.suffix) {
+			t.Errorf("message in %s (synced: %v) with flags %v: got %s, expected a file in %s ending with %s",
+				tt.dir, tt.synced, tt.flags, info.Filename, tt.newDir, tt.suffix)
+		}
+		if _, err = os.Stat(info.Filename); err != nil {
+			t.Error(err)
+		}
+	}
+}
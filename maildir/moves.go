@@ -0,0 +1,193 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"os"
+	"sort"
+
+	"github.com/yzzyx/imap-sync/mail"
+)
+
+// LocalMove describes a synchronized message that has been moved to another folder locally
+type LocalMove struct {
+	From    string    // Folder the message was synchronized in
+	UID     int       // UID of the message in that folder
+	Flags   []string  // Flags recorded at the last sync
+	Message mail.Info // The message in its new folder
+}
+
+// trackedMessage is a message recorded in the state of a folder
+type trackedMessage struct {
+	folderName string
+	uid        int
+	flags      []string
+}
+
+// LocalMoves finds synchronized messages that have been moved to another folder, e.g. by a mail client.
+// Such messages keep their name, including the UID from the old folder, which is used to tell them apart
+// from messages that have been deleted. Folders excluded by the folder filter are ignored.
+func (m *Maildir) LocalMoves() ([]LocalMove, error) {
+	moves, _, err := m.findMoves()
+	return moves, err
+}
+
+// DetachCopies marks synchronized messages that have been copied to another folder as not synchronized,
+// so that they're uploaded as new messages. Such messages keep the name of the original, including its UID,
+// which otherwise keeps them from being uploaded. Only copies in 'folderName' are detached, unless it's empty
+func (m *Maildir) DetachCopies(folderName string) error {
+	_, copies, err := m.findMoves()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range copies {
+		if folderName != "" && info.FolderName != folderName {
+			continue
+		}
+		_, err = m.DetachMessage(info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findMoves finds synchronized messages that are stored in another folder than the one they were synchronized in.
+// A message that only exists in a single other folder has been moved. Messages that still exist in
+// the old folder, or exist in several folders, have been copied
+func (m *Maildir) findMoves() (moves []LocalMove, copies []mail.Info, err error) {
+	folders, err := m.Folders()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tracked := make(map[string]trackedMessage)
+	present := make(map[string]bool)
+	var candidates []mail.Info
+	for _, folderName := range folders {
+		if m.include != nil && !m.include(folderName) {
+			continue
+		}
+
+		state, err := m.State(folderName)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, uid := range state.UIDs() {
+			ms, _ := state.Message(uid)
+			tracked[ms.Filename] = trackedMessage{folderName: folderName, uid: uid, flags: ms.Flags}
+		}
+
+		messages, err := m.ListMessages(folderName)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, info := range messages {
+			if info.UID == 0 {
+				continue
+			}
+
+			name := uniqueName(info.Filename)
+			if ms, ok := state.Message(info.UID); ok && ms.Filename == name {
+				present[name] = true
+				continue
+			}
+			candidates = append(candidates, info)
+		}
+	}
+
+	count := make(map[string]int)
+	for _, info := range candidates {
+		count[uniqueName(info.Filename)]++
+	}
+
+	for _, info := range candidates {
+		name := uniqueName(info.Filename)
+		t, ok := tracked[name]
+		if !ok || t.folderName == info.FolderName {
+			continue
+		}
+		if present[name] || count[name] > 1 {
+			copies = append(copies, info)
+			continue
+		}
+		moves = append(moves, LocalMove{
+			From:    t.folderName,
+			UID:     t.uid,
+			Flags:   t.flags,
+			Message: info,
+		})
+	}
+
+	sort.Slice(moves, func(i, j int) bool {
+		if moves[i].From != moves[j].From {
+			return moves[i].From < moves[j].From
+		}
+		return moves[i].UID < moves[j].UID
+	})
+	return moves, copies, nil
+}
+
+// RelabelOptions controls how RelabelMessage updates the local state
+type RelabelOptions struct {
+	Folder     string // Folder to move the message to, or "" to keep it in its folder
+	Record     bool   // Record the message under its new UID in the state of the folder
+	MergeFlags bool   // Don't record the flags as synchronized, so that they're merged with the flags on the server at the next sync
+	OldFolder  string // Folder in which the message was recorded under its old UID, or "" if its state should be left as is
+	OldUID     int    // UID of the message in the state of OldFolder
+}
+
+// RelabelMessage gives a synchronized message a new UID, e.g. after the UID validity of the folder has changed,
+// or after the message has been moved to another folder, locally or on the server.
+// If the new UID isn't known, the local copy is removed, so that it's downloaded again from the server
+func (m *Maildir) RelabelMessage(info mail.Info, uidValidity int, uid int, opts RelabelOptions) (mail.Info, error) {
+	if uid == 0 {
+		err := os.Remove(info.Filename)
+		if err != nil && !os.IsNotExist(err) {
+			return info, err
+		}
+	} else {
+		folderName := info.FolderName
+		if opts.Folder != "" {
+			folderName = opts.Folder
+		}
+
+		sort.Strings(info.Flags)
+		newPath := m.messagePath(folderName, messageDir(info.Filename), uid, info.Flags)
+		err := os.Rename(info.Filename, newPath)
+		if err != nil {
+			return info, err
+		}
+
+		relabeled := info
+		relabeled.FolderName = folderName
+		relabeled.Filename = newPath
+		relabeled.UIDValidity = uidValidity
+		relabeled.UID = uid
+
+		if opts.Record {
+			recorded := relabeled
+			if opts.MergeFlags {
+				recorded.Flags = nil
+			}
+			err = m.recordMessage(recorded)
+			if err != nil {
+				// Could not update state, move file back to avoid inconsistency
+				os.Rename(newPath, info.Filename)
+				return info, err
+			}
+		}
+		info = relabeled
+	}
+
+	if opts.OldFolder == "" {
+		return info, nil
+	}
+	s, err := m.State(opts.OldFolder)
+	if err != nil {
+		return info, err
+	}
+	return info, s.RemoveMessage(opts.OldUID)
+}
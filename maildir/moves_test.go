@@ -0,0 +1,169 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yzzyx/imap-sync/mail"
+)
+
+func TestLocalCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imap-sync-moves")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for _, name := range []string{"A", "B", "C"} {
+		err = m.CreateFolder(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var synced []mail.Info
+	for uid := 1; uid <= 2; uid++ {
+		info, err := m.AddMessage(mail.Info{
+			FolderName:  "A",
+			UIDValidity: 1,
+			UID:         uid,
+			Flags:       []string{mail.FlagSeen},
+		}, bytes.NewBufferString("Subject: test\r\n\r\ntest\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced = append(synced, info)
+	}
+
+	// The first message is copied to B, and the second is moved to C
+	data, err := ioutil.ReadFile(synced[0].Filename)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "B", dirCur, filepath.Base(synced[0].Filename)), data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(synced[1].Filename, filepath.Join(dir, "C", dirCur, filepath.Base(synced[1].Filename)))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan mail.Info, 10)
+	err = m.Scan(context.Background(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+
+	var scanned []mail.Info
+	for info := range ch {
+		scanned = append(scanned, info)
+	}
+	if len(scanned) != 1 || scanned[0].FolderName != "B" || scanned[0].UID != 0 || IsSynced(filepath.Base(scanned[0].Filename)) {
+		t.Fatalf("got new messages %v, expected the copy in folder B without a UID", scanned)
+	}
+	if !mail.FlagsEqual(scanned[0].Flags, []string{mail.FlagSeen}) {
+		t.Errorf("copy has flags %v, expected S", scanned[0].Flags)
+	}
+	if _, err = os.Stat(synced[0].Filename); err != nil {
+		t.Errorf("original message is missing: %v", err)
+	}
+
+	moves, err := m.LocalMoves()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 1 || moves[0].From != "A" || moves[0].UID != 2 || moves[0].Message.FolderName != "C" {
+		t.Errorf("got moves %v, expected UID 2 to be moved from A to C", moves)
+	}
+}
+
+func TestHasLocalChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m *Maildir, info mail.Info) error
+	}{
+		{"new message", func(m *Maildir, info mail.Info) error {
+			return ioutil.WriteFile(filepath.Join(m.folderPath("A"), dirNew, "1.local.host"), []byte("Subject: new\r\n\r\n"), 0600)
+		}},
+		{"deleted message", func(m *Maildir, info mail.Info) error {
+			return os.Remove(info.Filename)
+		}},
+		{"flags changed", func(m *Maildir, info mail.Info) error {
+			return os.Rename(info.Filename, info.Filename+"F")
+		}},
+		{"moved message", func(m *Maildir, info mail.Info) error {
+			return os.Rename(info.Filename, filepath.Join(m.folderPath("B"), dirCur, filepath.Base(info.Filename)))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "imap-sync-moves")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			m, err := New(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			for _, name := range []string{"A", "B"} {
+				err = m.CreateFolder(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Changes made while synchronizing are recorded in the state
+			info, err := m.AddMessage(mail.Info{
+				FolderName:  "A",
+				UIDValidity: 1,
+				UID:         1,
+				Flags:       []string{mail.FlagSeen},
+			}, bytes.NewBufferString("Subject: test\r\n\r\ntest\r\n"))
+			if err == nil {
+				info.Flags = []string{mail.FlagReplied, mail.FlagSeen}
+				info, err = m.RenameMessage(info)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"A", "B"} {
+				changed, err := m.HasLocalChanges(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if changed {
+					t.Fatalf("folder %s has local changes after synchronizing, expected none", name)
+				}
+			}
+
+			err = tt.change(m, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed, err := m.HasLocalChanges("A")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changed {
+				t.Error("folder A has no local changes")
+			}
+		})
+	}
+}
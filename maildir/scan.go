@@ -5,105 +5,184 @@ package maildir
 
 import (
 	"context"
-	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/yzzyx/imap-sync/mail"
 )
 
-// Scan writes all new messages to channel 'ch'
+// Scan writes all new messages to channel 'ch'.
+// Synchronized messages that have been copied to another folder count as new messages in that folder
 func (m *Maildir) Scan(ctx context.Context, ch chan<- mail.Info) error {
-	md, err := os.Open(m.path)
+	folders, err := m.Folders()
 	if err != nil {
 		return err
 	}
-	defer md.Close()
 
-	for {
-		entries, err := md.Readdir(10)
+	err = m.DetachCopies("")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range folders {
+		err = m.scanFolder(ctx, name, ch)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
+	}
+	return nil
+}
+
+// SetFolderFilter sets the function used to decide if a folder should be scanned for new messages.
+// By default, all folders are scanned
+func (m *Maildir) SetFolderFilter(include func(folderName string) bool) {
+	m.include = include
+}
+
+// ScanFolder writes all new messages in a single folder to channel 'ch'.
+// Nothing is written if the folder is excluded by the folder filter
+func (m *Maildir) ScanFolder(ctx context.Context, folderName string, ch chan<- mail.Info) error {
+	if m.include != nil && !m.include(folderName) {
+		return nil
+	}
+
+	err := m.DetachCopies(folderName)
+	if err != nil {
+		return err
+	}
+	return m.scanFolder(ctx, folderName, ch)
+}
+
+// scanFolder writes all new messages in a single folder to channel 'ch'
+func (m *Maildir) scanFolder(ctx context.Context, folderName string, ch chan<- mail.Info) error {
+	if m.include != nil && !m.include(folderName) {
+		return nil
+	}
+
+	messages, err := m.ListMessages(folderName)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range messages {
+		// Messages tagged as synced without a UID are only kept locally, e.g. messages moved to the trash
+		if info.UID > 0 || IsSynced(filepath.Base(info.Filename)) {
+			continue
+		}
+		ch <- info
+	}
+	return nil
+}
 
-		for _, e := range entries {
-			// Skip files at toplevel
-			if !e.IsDir() {
+// ListMessages returns all messages stored in a folder, both in cur/ and new/.
+// Messages that have not yet been synchronized will have UID set to 0
+func (m *Maildir) ListMessages(folderName string) ([]mail.Info, error) {
+	var messages []mail.Info
+	for _, dir := range []string{dirCur, dirNew} {
+		dirPath := filepath.Join(m.folderPath(folderName), dir)
+		entries, err := readDirNames(dirPath)
+		if err != nil {
+			// Folders created by other tools might not have a new/ directory
+			if dir == dirNew && os.IsNotExist(err) {
 				continue
 			}
-			name := e.Name()
+			return nil, err
+		}
+
+		for _, name := range entries {
 			if name[0] == '.' {
 				continue
 			}
 
-			// FIXME
-			// Check if folder is included in sync
-			//var include bool
-			//if len(mailbox.Folders.Include) > 0 {
-			//	for _, includeFolder := range mailbox.Folders.Include {
-			//		if name == includeFolder {
-			//			include = true
-			//			break
-			//		}
-			//	}
-			//} else {
-			//	include = true
-			//	for _, includeFolder := range mailbox.Folders.Exclude {
-			//		if name == includeFolder {
-			//			include = false
-			//			break
-			//		}
-			//	}
-			//}
-			//if !include {
-			//	continue
-			//}
-
-			err = m.checkMailbox(ctx, filepath.Join(m.path, name), name, ch)
-			if err != nil {
-				return err
+			info := mail.Info{
+				FolderName: folderName,
+				Filename:   filepath.Join(dirPath, name),
+				Flags:      parseFileFlags(name),
+			}
+			if IsSynced(name) {
+				info.UID = parseFileUID(name)
 			}
+			messages = append(messages, info)
 		}
 	}
-	return nil
+	return messages, nil
 }
 
-func (m *Maildir) checkMailbox(ctx context.Context, mailboxPath string, folderName string, ch chan<- mail.Info) error {
-	curPath := filepath.Join(mailboxPath, "cur")
-	md, err := os.Open(curPath)
+// readDirNames returns the names of all entries in a directory
+func readDirNames(path string) ([]string, error) {
+	fd, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer md.Close()
+	defer fd.Close()
+	return fd.Readdirnames(0)
+}
 
-	entries, err := md.Readdirnames(0)
+// SyncedMessages returns all messages in a folder that have been synchronized, indexed by UID
+func (m *Maildir) SyncedMessages(folderName string) (map[int]mail.Info, error) {
+	state, err := m.State(folderName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, name := range entries {
-		if name[0] == '.' {
+	messages, err := m.ListMessages(folderName)
+	if err != nil {
+		return nil, err
+	}
+
+	synced := make(map[int]mail.Info)
+	for _, info := range messages {
+		if info.UID == 0 {
 			continue
 		}
 
-		if IsSynced(name) {
+		// Make sure that the UID refers to the same message. Files that aren't part of the state,
+		// e.g. after an interrupted recovery from a UID validity change, might have a UID
+		// that now belongs to another message on the server
+		if ms, ok := state.Message(info.UID); !ok || ms.Filename != uniqueName(info.Filename) {
 			continue
 		}
-		messagePath := filepath.Join(curPath, name)
+		info.UIDValidity = state.UIDValidity()
+		synced[info.UID] = info
+	}
+	return synced, nil
+}
+
+// HasLocalChanges returns true if messages in a folder have been added, removed, moved or had their flags
+// changed since it was last synchronized. Changes made while synchronizing are recorded in the folder state,
+// so this can be used to tell changes made by the user apart from our own
+func (m *Maildir) HasLocalChanges(folderName string) (bool, error) {
+	state, err := m.State(folderName)
+	if err != nil {
+		return false, err
+	}
 
-		ch <- mail.Info{
-			FolderName: folderName,
-			Filename:   messagePath,
-			Flags:      parseFileFlags(name),
+	messages, err := m.ListMessages(folderName)
+	if err != nil {
+		return false, err
+	}
+
+	var synced int
+	for _, info := range messages {
+		if info.UID == 0 {
+			if !IsSynced(filepath.Base(info.Filename)) {
+				return true, nil
+			}
+			continue
+		}
+
+		ms, ok := state.Message(info.UID)
+		if !ok || ms.Filename != uniqueName(info.Filename) || !mail.FlagsEqual(ms.Flags, info.Flags) {
+			return true, nil
 		}
+		synced++
 	}
-	return nil
+	return synced != len(state.UIDs()), nil
 }
 
+// IsSynced returns true if the filename is tagged as synced by us
 func IsSynced(name string) bool {
 	pos := strings.Index(name, "S"+SyncUUID)
 	return pos > -1
@@ -131,3 +210,21 @@ func parseFileFlags(filename string) []string {
 	}
 	return flags
 }
+
+// parseFileUID returns the UID stored in the filename, or 0 if no UID is found
+func parseFileUID(filename string) int {
+	pos := strings.Index(filename, ",U=")
+	if pos == -1 {
+		return 0
+	}
+
+	s := filename[pos+3:]
+	if end := strings.IndexAny(s, ",:"); end > -1 {
+		s = s[:end]
+	}
+	uid, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return uid
+}
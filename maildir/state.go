@@ -0,0 +1,477 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stateFilename is the name of the file used to keep track of the synchronization state of a folder
+const stateFilename = ".imap-sync-state"
+
+// Operations stored in the state journal
+const (
+	opUIDValidity = "uidvalidity"
+	opMessage     = "message"
+	opRemove      = "remove"
+	opReset       = "reset"
+	opModSeq      = "modseq"
+)
+
+// stateRecord is a single entry in the state journal
+type stateRecord struct {
+	Op          string `json:"op"`
+	UIDValidity int    `json:"uidvalidity,omitempty"`
+	UID         int    `json:"uid,omitempty"`
+	Filename    string `json:"file,omitempty"`
+	Flags       string `json:"flags,omitempty"`
+	ModSeq      uint64 `json:"modseq,omitempty"`
+}
+
+// MessageState describes a message as it looked the last time it was synchronized
+type MessageState struct {
+	Filename string   // Unique part of the filename, without the flags suffix
+	Flags    []string // Flags agreed upon by both sides at the last sync
+}
+
+// FolderState keeps track of which messages in a folder have been synchronized,
+// and what they looked like at the time.
+//
+// The state is stored as an append-only journal, where each line is a JSON-encoded record.
+// Later records override earlier ones, and each record is flushed to disk as it's written.
+// When the state is closed, the journal is compacted by writing a new snapshot to a temporary file,
+// which is then renamed over the old one.
+//
+// A FolderState is safe for concurrent use.
+type FolderState struct {
+	mu          sync.Mutex
+	path        string
+	uidValidity int
+	lastUID     int
+	modSeq      uint64
+	messages    map[int]MessageState
+
+	journal   *os.File
+	records   int  // Number of records in the journal
+	truncated bool // Set if the journal ends with an incomplete record
+}
+
+// openState reads the synchronization state for a folder from disk.
+// If no state file exists, the state is migrated from the older .uidvalidity format.
+func (m *Maildir) openState(folderName string) (*FolderState, error) {
+	folderPath := m.folderPath(folderName)
+	s := &FolderState{
+		path:     filepath.Join(folderPath, stateFilename),
+		messages: make(map[int]MessageState),
+	}
+
+	err := s.load()
+	if errors.Is(err, os.ErrNotExist) {
+		err = m.migrateState(folderName, s)
+	} else if err == nil && s.truncated {
+		// Rewrite the journal before appending anything to it
+		err = s.compact()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the journal
+func (s *FolderState) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end == -1 {
+			// The last record was only partially written, so we'll ignore it.
+			// It will be removed when the journal is compacted.
+			s.truncated = true
+			break
+		}
+
+		line := data[:end]
+		data = data[end+1:]
+		if len(line) == 0 {
+			continue
+		}
+
+		var r stateRecord
+		err = json.Unmarshal(line, &r)
+		if err != nil {
+			return fmt.Errorf("cannot parse state file %s: %w", s.path, err)
+		}
+		s.apply(r)
+		s.records++
+	}
+	return nil
+}
+
+// apply updates the in-memory state with a journal record
+func (s *FolderState) apply(r stateRecord) {
+	switch r.Op {
+	case opUIDValidity:
+		s.uidValidity = r.UIDValidity
+		s.lastUID = r.UID
+	case opMessage:
+		var flags []string
+		for _, f := range r.Flags {
+			flags = append(flags, string(f))
+		}
+		// The last seen UID is not updated here, since messages we've uploaded
+		// might have been given a higher UID than messages we haven't downloaded yet
+		s.messages[r.UID] = MessageState{Filename: r.Filename, Flags: flags}
+	case opRemove:
+		delete(s.messages, r.UID)
+	case opReset:
+		s.uidValidity = r.UIDValidity
+		s.lastUID = 0
+		s.modSeq = 0
+		s.messages = make(map[int]MessageState)
+	case opModSeq:
+		s.modSeq = r.ModSeq
+	}
+}
+
+// write appends a record to the journal, and applies it to the in-memory state
+func (s *FolderState) write(r stateRecord) error {
+	if s.journal == nil {
+		fd, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		s.journal = fd
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	// Each record is written with a single call, so that a record is either written
+	// in its entirety or is incomplete, in which case it's ignored when loading.
+	// The record is flushed to disk before we go on, since the next step might depend on it,
+	// e.g. a downloaded message must not be fetched again after a crash
+	_, err = s.journal.Write(append(line, '\n'))
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	s.apply(r)
+	s.records++
+	return nil
+}
+
+// UIDValidity returns the UID validity of the folder at the last sync
+func (s *FolderState) UIDValidity() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.uidValidity
+}
+
+// LastUID returns the highest UID we've seen in the folder
+func (s *FolderState) LastUID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastUID
+}
+
+// HighestModSeq returns the highest mod-sequence (RFC 7162) of the folder at the last sync
+func (s *FolderState) HighestModSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.modSeq
+}
+
+// Message returns the state of a message, and a boolean indicating if the message is known
+func (s *FolderState) Message(uid int) (MessageState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms, ok := s.messages[uid]
+	return ms, ok
+}
+
+// UIDs returns a sorted list of all known UIDs in the folder
+func (s *FolderState) UIDs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.uids()
+}
+
+func (s *FolderState) uids() []int {
+	uids := make([]int, 0, len(s.messages))
+	for uid := range s.messages {
+		uids = append(uids, uid)
+	}
+	sort.Ints(uids)
+	return uids
+}
+
+// SetUIDValidity updates the UID validity and the last seen UID of the folder
+func (s *FolderState) SetUIDValidity(uidValidity int, lastUID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.uidValidity == uidValidity && s.lastUID == lastUID {
+		return nil
+	}
+	return s.write(stateRecord{Op: opUIDValidity, UIDValidity: uidValidity, UID: lastUID})
+}
+
+// SetHighestModSeq updates the highest mod-sequence of the folder
+func (s *FolderState) SetHighestModSeq(modSeq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.modSeq == modSeq {
+		return nil
+	}
+	return s.write(stateRecord{Op: opModSeq, ModSeq: modSeq})
+}
+
+// SetMessage records the state of a synchronized message
+func (s *FolderState) SetMessage(uid int, ms MessageState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sort.Strings(ms.Flags)
+	return s.write(stateRecord{
+		Op:       opMessage,
+		UID:      uid,
+		Filename: uniqueName(ms.Filename),
+		Flags:    strings.Join(ms.Flags, ""),
+	})
+}
+
+// RemoveMessage removes a message from the state
+func (s *FolderState) RemoveMessage(uid int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.messages[uid]; !ok {
+		return nil
+	}
+	return s.write(stateRecord{Op: opRemove, UID: uid})
+}
+
+// Reset removes all messages from the state, and sets a new UID validity
+func (s *FolderState) Reset(uidValidity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(stateRecord{Op: opReset, UIDValidity: uidValidity})
+}
+
+// Replace replaces the whole state, e.g. after the UID validity of the folder has changed.
+// The new state is written in a single step, so that either all of it or none of it is stored
+func (s *FolderState) Replace(uidValidity int, lastUID int, messages map[int]MessageState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newMessages := make(map[int]MessageState)
+	for uid, ms := range messages {
+		sort.Strings(ms.Flags)
+		newMessages[uid] = MessageState{Filename: uniqueName(ms.Filename), Flags: ms.Flags}
+	}
+
+	oldValidity, oldLastUID, oldModSeq, oldMessages := s.uidValidity, s.lastUID, s.modSeq, s.messages
+	s.uidValidity = uidValidity
+	s.lastUID = lastUID
+	s.modSeq = 0
+	s.messages = newMessages
+	err := s.compact()
+	if err != nil {
+		s.uidValidity, s.lastUID, s.modSeq, s.messages = oldValidity, oldLastUID, oldModSeq, oldMessages
+		return err
+	}
+	return nil
+}
+
+// Close compacts the journal, if necessary, and closes it
+func (s *FolderState) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal != nil {
+		err := s.journal.Close()
+		s.journal = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.records == s.compactSize() {
+		return nil
+	}
+	return s.compact()
+}
+
+// discard closes the journal without compacting it, e.g. when the folder is about to be removed
+func (s *FolderState) discard() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.Close()
+	s.journal = nil
+	return err
+}
+
+// compactSize returns the number of records in a compacted journal
+func (s *FolderState) compactSize() int {
+	// One header, one record per message, and the mod-sequence
+	n := len(s.messages) + 1
+	if s.modSeq > 0 {
+		n++
+	}
+	return n
+}
+
+// compact writes a snapshot of the current state to disk, replacing the journal
+func (s *FolderState) compact() error {
+	// The journal will be replaced, so any open handle must be closed first
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	fd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fd)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(stateRecord{Op: opUIDValidity, UIDValidity: s.uidValidity, UID: s.lastUID})
+	for _, uid := range s.uids() {
+		if err != nil {
+			break
+		}
+		ms := s.messages[uid]
+		err = enc.Encode(stateRecord{
+			Op:       opMessage,
+			UID:      uid,
+			Filename: ms.Filename,
+			Flags:    strings.Join(ms.Flags, ""),
+		})
+	}
+	if err == nil && s.modSeq > 0 {
+		err = enc.Encode(stateRecord{Op: opModSeq, ModSeq: s.modSeq})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	s.records = s.compactSize()
+	s.truncated = false
+	return nil
+}
+
+// migrateState creates a new state from the .uidvalidity file used by earlier versions,
+// and removes it once the new state has been written
+func (m *Maildir) migrateState(folderName string, s *FolderState) error {
+	uidValidityPath := filepath.Join(m.folderPath(folderName), ".uidvalidity")
+
+	intList, err := readIntLines(uidValidityPath, 2)
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing to migrate
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.uidValidity, s.lastUID = intList[0], intList[1]
+
+	messages, err := m.ListMessages(folderName)
+	if err != nil {
+		return err
+	}
+	for _, info := range messages {
+		if info.UID == 0 {
+			continue
+		}
+
+		// We have no record of the flags, so we'll leave them empty,
+		// which causes them to be merged at the next sync
+		s.messages[info.UID] = MessageState{Filename: uniqueName(info.Filename)}
+	}
+
+	err = s.compact()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(uidValidityPath)
+	return nil
+}
+
+// readIntLines reads the first 'count' lines of a file as integers
+func readIntLines(path string, count int) ([]int, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	intList := make([]int, count)
+	for row := 0; row < count && scanner.Scan(); row++ {
+		intList[row], err = strconv.Atoi(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return intList, nil
+}
+
+// uniqueName returns the unique part of a maildir filename, without path and flags
+func uniqueName(filename string) string {
+	name := filepath.Base(filename)
+	if pos := strings.Index(name, ":2,"); pos > -1 {
+		name = name[:pos]
+	}
+	return name
+}
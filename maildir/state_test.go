@@ -0,0 +1,252 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yzzyx/imap-sync/mail"
+)
+
+// openFolderState opens the maildir in 'dir', and returns the state of folder A
+func openFolderState(t *testing.T, dir string) (*Maildir, *FolderState) {
+	t.Helper()
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.CreateFolder("A")
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	s, err := m.State("A")
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	return m, s
+}
+
+// checkState checks the contents of a folder state
+func checkState(t *testing.T, s *FolderState, uidValidity, lastUID int, modSeq uint64, messages map[int]MessageState) {
+	t.Helper()
+
+	if s.UIDValidity() != uidValidity || s.LastUID() != lastUID || s.HighestModSeq() != modSeq {
+		t.Errorf("got UID validity %d, last UID %d and mod-sequence %d, expected %d, %d and %d",
+			s.UIDValidity(), s.LastUID(), s.HighestModSeq(), uidValidity, lastUID, modSeq)
+	}
+	uids := s.UIDs()
+	if len(uids) != len(messages) {
+		t.Errorf("got UIDs %v, expected %d messages", uids, len(messages))
+	}
+	for uid, expected := range messages {
+		ms, ok := s.Message(uid)
+		if !ok || ms.Filename != expected.Filename || !mail.FlagsEqual(ms.Flags, expected.Flags) {
+			t.Errorf("got message %+v for UID %d, expected %+v", ms, uid, expected)
+		}
+	}
+}
+
+// journalLines returns the lines in the state journal of folder A
+func journalLines(t *testing.T, dir string) []string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "A", stateFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestStateReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imap-sync-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, s := openFolderState(t, dir)
+	err = s.SetUIDValidity(5, 10)
+	if err == nil {
+		err = s.SetMessage(1, MessageState{Filename: "1.a,U=1:2,S", Flags: []string{mail.FlagSeen}})
+	}
+	if err == nil {
+		err = s.SetMessage(2, MessageState{Filename: "2.b,U=2:2,", Flags: nil})
+	}
+	if err == nil {
+		err = s.SetMessage(1, MessageState{Filename: "1.a,U=1:2,FS", Flags: []string{mail.FlagSeen, mail.FlagFlagged}})
+	}
+	if err == nil {
+		err = s.RemoveMessage(2)
+	}
+	if err == nil {
+		err = s.SetHighestModSeq(42)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]MessageState{1: {Filename: "1.a,U=1", Flags: []string{mail.FlagFlagged, mail.FlagSeen}}}
+	checkState(t, s, 5, 10, 42, expected)
+
+	// The journal is replayed if we crash before the state is closed
+	if lines := journalLines(t, dir); len(lines) != 6 {
+		t.Errorf("journal contains %d records, expected 6", len(lines))
+	}
+	crashed, s2 := openFolderState(t, dir)
+	checkState(t, s2, 5, 10, 42, expected)
+	crashed.Close()
+
+	// Closing the state compacts the journal
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := journalLines(t, dir); len(lines) != 3 {
+		t.Errorf("compacted journal contains %d records, expected 3: %v", len(lines), lines)
+	}
+
+	m, s = openFolderState(t, dir)
+	checkState(t, s, 5, 10, 42, expected)
+
+	// Replacing the state removes the mod-sequence, along with the old messages
+	replaced := map[int]MessageState{7: {Filename: "7.c", Flags: []string{mail.FlagReplied}}}
+	err = s.Replace(6, 7, replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, s, 6, 7, 0, replaced)
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, s = openFolderState(t, dir)
+	defer m.Close()
+	checkState(t, s, 6, 7, 0, replaced)
+}
+
+func TestStatePartialRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imap-sync-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, s := openFolderState(t, dir)
+	err = s.SetUIDValidity(5, 10)
+	if err == nil {
+		err = s.SetMessage(1, MessageState{Filename: "1.a", Flags: []string{mail.FlagSeen}})
+	}
+	if err == nil {
+		err = m.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash while the next record was written
+	journal := filepath.Join(dir, "A", stateFilename)
+	fd, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = fd.WriteString(`{"op":"message","uid":2,"fi`)
+		fd.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2, s2 := openFolderState(t, dir)
+	expected := map[int]MessageState{1: {Filename: "1.a", Flags: []string{mail.FlagSeen}}}
+	checkState(t, s2, 5, 10, 0, expected)
+
+	// The partial record is removed before anything else is written
+	data, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) || bytes.Contains(data, []byte(`"uid":2`)) {
+		t.Errorf("journal still contains the partial record: %q", data)
+	}
+	err = s2.SetMessage(3, MessageState{Filename: "3.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2.Close()
+
+	m, s = openFolderState(t, dir)
+	defer m.Close()
+	expected[3] = MessageState{Filename: "3.c"}
+	checkState(t, s, 5, 10, 0, expected)
+}
+
+func TestMigrateState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imap-sync-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	err = m.CreateFolder("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Earlier versions stored the UID validity and the last seen UID in .uidvalidity,
+	// and the UIDs of the messages in their filenames
+	uidValidityPath := filepath.Join(dir, "A", ".uidvalidity")
+	err = ioutil.WriteFile(uidValidityPath, []byte("7\n12\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{
+		m.messagePath("A", dirCur, 3, []string{mail.FlagSeen}),
+		m.messagePath("A", dirNew, 5, nil),
+		filepath.Join(dir, "A", dirCur, m.unsyncedFilename([]string{mail.FlagSeen})),
+	}
+	for _, path := range files {
+		err = ioutil.WriteFile(path, []byte("Subject: test\r\n\r\ntest\r\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := m.State("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The flags aren't known, so they are merged at the next sync
+	expected := map[int]MessageState{
+		3: {Filename: uniqueName(files[0])},
+		5: {Filename: uniqueName(files[1])},
+	}
+	checkState(t, s, 7, 12, 0, expected)
+
+	if _, err = os.Stat(uidValidityPath); !os.IsNotExist(err) {
+		t.Errorf(".uidvalidity was not removed after migrating: %v", err)
+	}
+
+	// The migrated state is stored on disk
+	m2, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Close()
+	s2, err := m2.State("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, s2, 7, 12, 0, expected)
+}
@@ -0,0 +1,147 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package maildir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// Events in cur/ and new/ that indicates that a message has been added, removed or renamed
+	messageEvents = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	// Events in folder directories that might indicate that a new folder has been created
+	folderEvents = syscall.IN_CREATE | syscall.IN_MOVED_TO
+)
+
+// watcher keeps track of the inotify watches of a maildir
+type watcher struct {
+	m       *Maildir
+	fd      int
+	folders map[int32]string // Watch descriptor to folder name, for cur/ and new/
+	dirs    map[int32]bool   // Watch descriptors for folder directories
+}
+
+// Watch waits for changes in the maildir, and sends the name of the folder on 'changed' whenever
+// a message is added, removed or renamed. On Linux, inotify is used and 'pollInterval' is ignored.
+// Watch blocks until the context is cancelled or an error occurs.
+func (m *Maildir) Watch(ctx context.Context, pollInterval time.Duration, changed chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+
+	// Since the descriptor is non-blocking, reads can be interrupted by closing the file
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	w := &watcher{
+		m:       m,
+		fd:      fd,
+		folders: make(map[int32]string),
+		dirs:    make(map[int32]bool),
+	}
+	err = w.addWatches()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		rescan := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				rescan = true
+				continue
+			}
+			if name == "" || name[0] == '.' {
+				continue
+			}
+
+			if folderName, ok := w.folders[event.Wd]; ok {
+				select {
+				case changed <- folderName:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			} else if w.dirs[event.Wd] && event.Mask&syscall.IN_ISDIR != 0 {
+				rescan = true
+			}
+		}
+
+		if rescan {
+			err = w.addWatches()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// addWatches walks the maildir and adds watches for all folders.
+// Adding a watch for a directory that is already watched is harmless.
+func (w *watcher) addWatches() error {
+	return filepath.Walk(w.m.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory might have been removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		name := info.Name()
+		if name == "cur" || name == "new" {
+			relPath, err := filepath.Rel(w.m.path, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			folderName, ok := w.m.folderNameFromPath(relPath)
+			if !ok {
+				return filepath.SkipDir
+			}
+			wd, err := syscall.InotifyAddWatch(w.fd, path, messageEvents)
+			if err != nil {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			w.folders[int32(wd)] = folderName
+			return filepath.SkipDir
+		}
+		if w.m.skipDir(path, name) {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, folderEvents|syscall.IN_ONLYDIR)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.dirs[int32(wd)] = true
+		return nil
+	})
+}
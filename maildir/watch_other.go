@@ -0,0 +1,91 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+
+//go:build !linux
+// +build !linux
+
+package maildir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Watch waits for changes in the maildir, and sends the name of the folder on 'changed' whenever
+// a message is added, removed or renamed. The maildir is polled every 'pollInterval', by comparing
+// the modification times of the cur/ and new/ directories of each folder.
+// Watch blocks until the context is cancelled or an error occurs.
+func (m *Maildir) Watch(ctx context.Context, pollInterval time.Duration, changed chan<- string) error {
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+
+	modTimes, err := m.dirModTimes()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+
+		current, err := m.dirModTimes()
+		if err != nil {
+			return err
+		}
+
+		for path, t := range current {
+			if prev, ok := modTimes[path]; ok && prev.Equal(t) {
+				continue
+			}
+
+			relPath, err := filepath.Rel(m.path, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			folderName, ok := m.folderNameFromPath(relPath)
+			if !ok {
+				continue
+			}
+			select {
+			case changed <- folderName:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		modTimes = current
+	}
+}
+
+// dirModTimes returns the modification time of all cur/ and new/ directories in the maildir
+func (m *Maildir) dirModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	err := filepath.Walk(m.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		name := info.Name()
+		if name == "cur" || name == "new" {
+			modTimes[path] = info.ModTime()
+			return filepath.SkipDir
+		}
+		if m.skipDir(path, name) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return modTimes, err
+}
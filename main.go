@@ -10,15 +10,15 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/yzzyx/imap-sync/config"
-	"github.com/yzzyx/imap-sync/imap"
-	"github.com/yzzyx/imap-sync/literal"
-	"github.com/yzzyx/imap-sync/mail"
-	"github.com/yzzyx/imap-sync/maildir"
 	"gopkg.in/yaml.v2"
 )
 
@@ -65,6 +65,7 @@ func main() {
 	configPath := filepath.Join(cfgDir, "imap-sync", "config.yml")
 
 	configFile := flag.String("config", configPath, "Use specific configuration file")
+	daemon := flag.Bool("daemon", false, "Keep running, and synchronize changes as they happen")
 	flag.Parse()
 
 	cfgData, err := ioutil.ReadFile(*configFile)
@@ -80,76 +81,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create a IMAP setup for each mailbox
-	for name, mailbox := range cfg.Mailboxes {
-		if mailbox.Maildir == "" {
-			log.Printf("maildir not set for mailbox %s, skipping", name)
-			continue
-		}
-		maildirPath := parsePathSetting(mailbox.Maildir)
-
-		// Create maildir if it doesnt exist
-		err = os.MkdirAll(maildirPath, 0700)
-		if err != nil {
-			panic(err)
-		}
-
-		md, err := maildir.New(maildirPath)
-		if err != nil {
-			log.Printf("cannot create new maildir instance: %v\n", err)
-			return
-		}
-
-		imapHandler, err := imap.New(mailbox)
-		if err != nil {
-			log.Printf("cannot initalize new imap connection: %v\n", err)
-			return
-		}
-
-		ch := make(chan mail.Info, 100)
+	if *daemon {
+		ctx, cancel := context.WithCancel(ctx)
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		go func() {
-			err = md.Scan(ctx, ch)
-			if err != nil {
-				log.Printf("cannot scan maildir: %v\n", err)
-				return
-			}
-			close(ch)
+			<-sigChan
+			cancel()
 		}()
 
-		// Upload any new files in our mail dirs to the server,
-		// and then rename the messages to match our UID's
-		for m := range ch {
-			fd, err := os.Open(m.Filename)
-			if err != nil {
-				log.Printf("could not open file %s: %v", m.Filename, err)
-				return
+		// Each mailbox is watched separately, until we're interrupted
+		var wg sync.WaitGroup
+		for name, mailbox := range cfg.Mailboxes {
+			if mailbox.Maildir == "" {
+				log.Printf("maildir not set for mailbox %s, skipping", name)
+				continue
 			}
-			info, err := imapHandler.AddMessage(m, &literal.FileLiteral{fd})
-			if err != nil {
-				log.Printf("could not upload message: %v", err)
-				return
-			}
-			fd.Close()
-			info, err = md.RenameMessage(info)
-			if err != nil {
-				log.Printf("could not rename message: %v", err)
-				return
-			}
-			fmt.Printf(" upload %+v\n", m)
-		}
 
-		err = imapHandler.CheckMessages(ctx, md)
-		if err != nil {
-			log.Printf("cannot check for new messages on server: %v\n", err)
-			return
+			wg.Add(1)
+			go func(name string, mailbox config.Mailbox) {
+				defer wg.Done()
+				err := runDaemon(ctx, name, mailbox)
+				if err != nil {
+					log.Printf("%s: %v", name, err)
+				}
+			}(name, mailbox)
 		}
+		wg.Wait()
+		return
+	}
+
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = config.DefaultWorkers
+	}
+
+	results := syncAccounts(ctx, cfg.Mailboxes, workers)
 
-		err = imapHandler.Close()
-		if err != nil {
-			log.Printf("Cannot close imap handler: %v", err)
-			return
+	// Summarize the results, since log messages from different mailboxes are interleaved
+	failed := 0
+	fmt.Println("\nSummary:")
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Printf("  %s: failed after %s: %v\n", r.name, r.duration.Round(time.Millisecond), r.err)
+			continue
 		}
+		fmt.Printf("  %s: ok (%d uploaded, %s)\n", r.name, r.uploaded, r.duration.Round(time.Millisecond))
 	}
 
+	if failed > 0 {
+		fmt.Printf("%d of %d mailboxes failed\n", failed, len(results))
+		os.Exit(1)
+	}
 	return
 }
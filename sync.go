@@ -0,0 +1,286 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yzzyx/imap-sync/config"
+	"github.com/yzzyx/imap-sync/imap"
+	"github.com/yzzyx/imap-sync/literal"
+	"github.com/yzzyx/imap-sync/mail"
+	"github.com/yzzyx/imap-sync/maildir"
+)
+
+// account keeps track of the local maildir and the IMAP connection for a configured mailbox
+type account struct {
+	name    string
+	mailbox config.Mailbox
+	md      *maildir.Maildir
+	imap    *imap.Handler
+
+	uploaded int // Number of messages uploaded to the server
+}
+
+// openAccount creates the maildir if it doesn't exist, and connects to the IMAP server
+func openAccount(name string, mailbox config.Mailbox) (*account, error) {
+	maildirPath := parsePathSetting(mailbox.Maildir)
+
+	// Create maildir if it doesnt exist
+	err := os.MkdirAll(maildirPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range []*string{&mailbox.TLSCAFile, &mailbox.TLSCertFile, &mailbox.TLSKeyFile} {
+		if *path != "" {
+			*path = parsePathSetting(*path)
+		}
+	}
+	if mailbox.OAuth2 != nil {
+		oauth2 := *mailbox.OAuth2
+		if oauth2.TokenCache != "" {
+			oauth2.TokenCache = parsePathSetting(oauth2.TokenCache)
+		}
+		if oauth2.RefreshTokenFile != "" {
+			oauth2.RefreshTokenFile = parsePathSetting(oauth2.RefreshTokenFile)
+		}
+		mailbox.OAuth2 = &oauth2
+	}
+
+	md, err := maildir.New(maildirPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create new maildir instance: %w", err)
+	}
+
+	imapHandler, err := imap.New(mailbox)
+	if err != nil {
+		md.Close()
+		return nil, fmt.Errorf("cannot initalize new imap connection: %w", err)
+	}
+
+	delimiter, err := imapHandler.Delimiter()
+	if err == nil {
+		err = md.SetLayout(mailbox.Layout, delimiter)
+	}
+	if err == nil {
+		err = md.SetFolderMap(imapHandler.FolderMap())
+	}
+	if err != nil {
+		imapHandler.Close()
+		md.Close()
+		return nil, err
+	}
+	md.SetFolderFilter(imapHandler.FolderIncluded)
+
+	return &account{
+		name:    name,
+		mailbox: mailbox,
+		md:      md,
+		imap:    imapHandler,
+	}, nil
+}
+
+// Close logs out from the server, and saves the maildir state
+func (a *account) Close() error {
+	err := a.imap.Close()
+	if err != nil {
+		a.md.Close()
+		return fmt.Errorf("cannot close imap handler: %w", err)
+	}
+
+	err = a.md.Close()
+	if err != nil {
+		return fmt.Errorf("cannot save maildir state: %w", err)
+	}
+	return nil
+}
+
+// upload sends any new files in our mail dirs to the server,
+// and then renames the messages to match our UID's.
+// If folderName is empty, all folders are scanned
+func (a *account) upload(ctx context.Context, folderName string) error {
+	ch := make(chan mail.Info, 100)
+	scanErr := make(chan error, 1)
+	go func() {
+		var err error
+		if folderName == "" {
+			err = a.md.Scan(ctx, ch)
+		} else {
+			err = a.md.ScanFolder(ctx, folderName, ch)
+		}
+		close(ch)
+		scanErr <- err
+	}()
+
+	var err error
+	for m := range ch {
+		if err != nil {
+			// Let the scan finish
+			continue
+		}
+		err = a.uploadMessage(ctx, m)
+	}
+
+	if e := <-scanErr; e != nil {
+		return fmt.Errorf("cannot scan maildir: %w", e)
+	}
+	return err
+}
+
+// uploadMessage uploads a single message.
+// If the connection is lost, the upload is retried once we've reconnected
+func (a *account) uploadMessage(ctx context.Context, m mail.Info) error {
+	var info mail.Info
+	up := &imap.Upload{Info: m}
+	err := a.imap.Retry(ctx, "uploading "+m.Filename, func() error {
+		// Servers without UIDPLUS don't tell us the UID of the message, so we have to find it by its Message-ID
+		required, err := a.imap.RequiresMessageID()
+		if err == nil && required {
+			err = a.md.EnsureMessageID(m)
+		}
+		if err != nil {
+			return err
+		}
+
+		fd, err := os.Open(m.Filename)
+		if err != nil {
+			return fmt.Errorf("could not open file %s: %w", m.Filename, err)
+		}
+		defer fd.Close()
+
+		info, err = a.imap.AddMessage(up, &literal.FileLiteral{File: fd})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload message: %w", err)
+	}
+
+	info, err = a.md.RenameMessage(info)
+	if err != nil {
+		return fmt.Errorf("could not rename message: %w", err)
+	}
+	fmt.Printf(" upload %+v\n", m)
+	a.uploaded++
+	return nil
+}
+
+// sync uploads new local messages, and synchronizes all folders with the server
+func (a *account) sync(ctx context.Context) error {
+	err := a.imap.Refresh()
+	if err != nil {
+		return fmt.Errorf("cannot reconnect: %w", err)
+	}
+
+	// Make sure every folder exists on both sides, before any messages are uploaded
+	err = a.imap.SyncFolders(ctx, a.md)
+	if err != nil {
+		return fmt.Errorf("cannot synchronize folders: %w", err)
+	}
+
+	err = a.upload(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	err = a.imap.CheckMessages(ctx, a.md)
+	if err != nil {
+		return fmt.Errorf("cannot check for new messages on server: %w", err)
+	}
+	return nil
+}
+
+// syncFolder uploads new local messages in a single folder, and synchronizes it with the server
+func (a *account) syncFolder(ctx context.Context, folderName string) error {
+	err := a.imap.Refresh()
+	if err != nil {
+		return fmt.Errorf("cannot reconnect: %w", err)
+	}
+
+	// Messages might have been moved locally to a folder that doesn't exist on the server yet
+	err = a.imap.SyncFolders(ctx, a.md)
+	if err != nil {
+		return fmt.Errorf("cannot synchronize folders: %w", err)
+	}
+
+	err = a.upload(ctx, folderName)
+	if err != nil {
+		return err
+	}
+	return a.imap.SyncFolder(ctx, a.md, folderName)
+}
+
+// syncResult describes the outcome of synchronizing a mailbox
+type syncResult struct {
+	name     string
+	err      error
+	uploaded int
+	duration time.Duration
+}
+
+// syncAccount synchronizes all folders of a mailbox once
+func syncAccount(ctx context.Context, name string, mailbox config.Mailbox) syncResult {
+	start := time.Now()
+	res := syncResult{name: name}
+
+	a, err := openAccount(name, mailbox)
+	if err != nil {
+		res.err = err
+		res.duration = time.Since(start)
+		return res
+	}
+
+	res.err = a.sync(ctx)
+	res.uploaded = a.uploaded
+	if err = a.Close(); res.err == nil {
+		res.err = err
+	}
+	res.duration = time.Since(start)
+	return res
+}
+
+// syncAccounts synchronizes all mailboxes, with at most 'workers' mailboxes at the same time.
+// A failure in one mailbox doesn't affect the others.
+// The results are returned in the same order as the mailbox names are sorted
+func syncAccounts(ctx context.Context, mailboxes map[string]config.Mailbox, workers int) []syncResult {
+	var names []string
+	for name, mailbox := range mailboxes {
+		if mailbox.Maildir == "" {
+			log.Printf("maildir not set for mailbox %s, skipping", name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]syncResult, len(names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				name := names[idx]
+				results[idx] = syncAccount(ctx, name, mailboxes[name])
+				if err := results[idx].err; err != nil {
+					log.Printf("%s: %v", name, err)
+				}
+			}
+		}()
+	}
+
+	for idx := range names {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}